@@ -1,13 +1,144 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"kvstore/protocol"
 )
 
+// requestID numbers the frames sent on the current connection
+var requestID uint32
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine returns the next line typed by the user without its line ending.
+func readLine() string {
+	line, _ := stdin.ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+// readArg reads a key or value. The whole line is taken as-is, so spaces are
+// kept; a line written as a Go quoted string ("a\nb\x00") is unquoted so
+// newlines and arbitrary bytes can be entered too.
+func readArg() string {
+	line := readLine()
+	if strings.HasPrefix(line, "\"") {
+		if unquoted, err := strconv.Unquote(line); err == nil {
+			return unquoted
+		}
+	}
+	return line
+}
+
+// readLevel asks for the consistency level of a read or write.
+func readLevel() string {
+	fmt.Printf("Enter the consistency level (ONE/QUORUM/ALL or a count, blank for the default): ")
+	return strings.ToUpper(strings.TrimSpace(readLine()))
+}
+
+// printReply shows the outcome of a request.
+func printReply(key string, reply protocol.Frame) {
+	args, _ := reply.Args()
+	switch reply.Op {
+	case protocol.OpNotFound:
+		fmt.Printf("Key %q not found\n", key)
+	case protocol.OpValue:
+		if len(args) >= 3 {
+			fmt.Printf("Value for key %q = %s (version %s)\n", key, args[1], args[2])
+		}
+		if len(args) >= 4 {
+			fmt.Printf("Answered by %s replica(s)\n", args[3])
+		}
+	case protocol.OpConflict:
+		if len(args) >= 2 {
+			fmt.Printf("Conflict: key %q is at version %s\n", key, args[1])
+		}
+	case protocol.OpError:
+		fmt.Printf("Error: %s\n", strings.Join(args, " "))
+	case protocol.OpRedirect:
+		if len(args) > 0 && args[0] != "" {
+			fmt.Printf("The server is no longer the leader; reconnecting to %s\n", args[0])
+		} else {
+			fmt.Println("The server is no longer the leader; reconnecting")
+		}
+	case protocol.OpOK:
+		if len(args) == 3 && args[0] == "WRITE_DONE" {
+			fmt.Printf("Key %q written at version %s, acknowledged by %s replica(s)\n", key, args[1], args[2])
+		} else if len(args) == 2 && args[0] == "DELETED" {
+			fmt.Printf("Key %q deleted, acknowledged by %s replica(s)\n", key, args[1])
+		} else {
+			fmt.Printf("Server response: %s %s\n", reply.Op, strings.Join(args, " "))
+		}
+	default:
+		fmt.Printf("Server response: %s %s\n", reply.Op, strings.Join(args, " "))
+	}
+}
+
+// scanPage fetches one page of a SCAN, prints its entries and returns the
+// cursor for the next page, "" once there are no more.
+func scanPage(conn net.Conn, cursor, end, prefix, count string) (string, error) {
+	reply, err := sendRequest(conn, protocol.OpScan, cursor, end, prefix, count)
+	if err != nil {
+		return "", err
+	}
+	if reply.Op != protocol.OpPage {
+		printReply("", reply)
+		return "", nil
+	}
+	results, _ := reply.Args()
+	for i := 1; i+2 < len(results); i += 3 {
+		fmt.Printf("%q = %s (version %s)\n", results[i], results[i+1], results[i+2])
+	}
+	if len(results) == 0 {
+		return "", nil
+	}
+	return results[0], nil
+}
+
+// replyTimeout is how long a request may take before the server is given
+// up on. The master gives slaves 3 seconds to answer each step of a write
+// (reading the key's version, writing it, then writing to substitutes for
+// each round of replicas that didn't answer), and a transaction also waits
+// up to 2 seconds for the backup masters, so a reply can take many times 3
+// seconds without anything being wrong.
+const replyTimeout = time.Minute
+
+// sendRequest writes one framed request and waits for the matching reply.
+// A REDIRECT reply names the new leader, which is where we reconnect.
+func sendRequest(conn net.Conn, op protocol.Op, args ...string) (protocol.Frame, error) {
+	requestID++
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	err := protocol.WriteFrame(conn, protocol.NewFrame(op, requestID, args...))
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return protocol.Frame{}, err
+		}
+		if frame.ReqID != requestID {
+			continue
+		}
+		if frame.Op == protocol.OpRedirect {
+			// An empty address means the server knows no leader yet, so
+			// the next connection goes down the list of masters
+			if redirect, _ := frame.Args(); len(redirect) > 0 {
+				leaderHint = redirect[0]
+			}
+		}
+		return frame, nil
+	}
+}
+
 func checkPortInUse(port string) bool {
 	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
@@ -17,30 +148,81 @@ func checkPortInUse(port string) bool {
 	return false
 }
 
+// leaderHint is where the last server that redirected us said the leader
+// is; it is tried before the fixed list of masters.
+var leaderHint string
+
+// dialServer connects to addr and says HELLO. A server that isn't the
+// leader answers with a REDIRECT naming the leader, which is followed for a
+// few hops; it returns the connection and the address it ended up at.
+func dialServer(addr string) (net.Conn, string) {
+	for hops := 0; hops < 3 && addr != ""; hops++ {
+		conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+		if err != nil {
+			return nil, ""
+		}
+		protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpHello, 0, "CLIENT")) // Send message
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, err := protocol.ReadFrame(conn)
+		if err != nil {
+			conn.Close()
+			return nil, ""
+		}
+		if reply.Op == protocol.OpOK {
+			return conn, addr
+		}
+		conn.Close()
+		args, _ := reply.Args()
+		if reply.Op != protocol.OpRedirect || len(args) == 0 {
+			return nil, ""
+		}
+		// An empty address means no leader is known yet
+		fmt.Printf("%s is not the leader, redirected to %q\n", addr, args[0])
+		addr = args[0]
+	}
+	return nil, ""
+}
+
 func connectToServer(primaryPort string, backupPort [3]string) (net.Conn, bool) {
+	primary := "localhost:" + primaryPort
+	if leaderHint != "" {
+		if conn, addr := dialServer(leaderHint); conn != nil {
+			fmt.Println("Connected to leader", addr)
+			return conn, addr == primary
+		}
+		leaderHint = ""
+	}
+
 	// Try to connect to the primary master first
-	conn, err := net.DialTimeout("tcp", "localhost:"+primaryPort, 2*time.Second)
-	if err == nil {
-		fmt.Println("Connected to Master Server!!")
-		conn.Write([]byte("CLIENT")) // Send message
-		return conn, true
+	conn, addr := dialServer(primary)
+	if conn != nil {
+		if addr == primary {
+			fmt.Println("Connected to Master Server!!")
+		} else {
+			fmt.Println("Connected to leader", addr)
+		}
+		leaderHint = addr
+		return conn, addr == primary
 	}
-	
+
 	// If primary connection fails, try backup
 	fmt.Println("Connection to Master Server failed, connecting to Backup Master...")
 	for i := 0; i < 3; i++ {
-		conn, err = net.DialTimeout("tcp", "localhost:"+backupPort[i], 2*time.Second)
-		if err == nil {
-			fmt.Println("Connected to Backup Master Server !!", i)
-			conn.Write([]byte("CLIENT")) // Send message
-			return conn, false
-		} 
+		conn, addr = dialServer("localhost:" + backupPort[i])
+		if conn != nil {
+			fmt.Println("Connected to Backup Master Server !!", addr)
+			leaderHint = addr
+			return conn, addr == primary
+		}
 	}
-	
+
 	fmt.Println("Failed to connect to both Master and Backup servers.")
 	return nil, false
 }
 
+// operations lists what the prompt offers
+const operations = "READ/WRITE/DELETE/EXPIRE/PERSIST/CAS/SETNX/INCRBY/DECRBY/APPEND/MGET/MSET/MULTI/SCAN/KEYS/STATS/HEALTH/EXIT"
+
 func main() {
 	primaryPort := "12345"
 	backupPort := [3]string{"12346","12347","12348"}
@@ -60,78 +242,285 @@ func main() {
 		for {
 			var input string
 			if connectedToPrimary {
-				fmt.Printf("[PRIMARY] Enter the Operation you would like to perform (READ/WRITE/EXIT): ")
+				fmt.Printf("[PRIMARY] Enter the Operation you would like to perform (%s): ", operations)
 			} else {
-				fmt.Printf("[BACKUP] Enter the Operation you would like to perform (READ/WRITE/EXIT): ")
+				fmt.Printf("[BACKUP] Enter the Operation you would like to perform (%s): ", operations)
 			}
-			fmt.Scanln(&input)
-			input = strings.ToUpper(input)
+			input = strings.ToUpper(strings.TrimSpace(readLine()))
 			
 			if input == "EXIT" {
 				fmt.Println("Exiting Client...")
 				os.Exit(0)
-			} else if input == "READ" || input == "WRITE" {
+			} else if input == "READ" || input == "WRITE" || input == "DELETE" || input == "EXPIRE" || input == "PERSIST" || input == "CAS" || input == "SETNX" ||
+				input == "INCRBY" || input == "DECRBY" || input == "APPEND" {
 				fmt.Printf("Enter the key you want to perform the operation on: ")
-				var key string
-				fmt.Scanln(&key)
+				key := readArg()
 				
 				if input == "READ" {
-					fmt.Printf("Sending READ Operation for key %s\n\n", key)
-					conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-					_, err := conn.Write([]byte(input + " " + key + " "))
+					level := readLevel()
+					fmt.Printf("Sending READ Operation for key %q\n\n", key)
+					reply, err := sendRequest(conn, protocol.OpRead, key, level)
 					if err != nil {
-						fmt.Println("Error sending request to server:", err)
+						fmt.Println("Error talking to server:", err)
 						break
 					}
-
-					buf := make([]byte, 1024)
-					conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-					n, err := conn.Read(buf) // Read response
+					
+					fmt.Printf("Server response: %s\n", reply.Op)
+					printReply(key, reply)
+				} else if input == "WRITE" {
+					fmt.Printf("Enter the value: ")
+					new_val := readArg()
+					fmt.Printf("Enter the TTL in seconds (blank for none): ")
+					ttl := strings.TrimSpace(readLine())
+					level := readLevel()
+					fmt.Printf("Sending WRITE Operation for key %q with value %q\n", key, new_val)
+					
+					reply, err := sendRequest(conn, protocol.OpWrite, key, new_val, ttl, level)
 					if err != nil {
-						fmt.Println("Error receiving response from server:", err)
+						fmt.Println("Error talking to server:", err)
 						break
 					}
-					
-					response := string(buf[:n])
-					fmt.Printf("Server response: %s\n", response)
-					if response == "NOT FOUND" {
-						fmt.Printf("Key %s not found\n", key)
+					printReply(key, reply)
+				} else if input == "DELETE" {
+					level := readLevel()
+					fmt.Printf("Sending DELETE Operation for key %q\n", key)
+					reply, err := sendRequest(conn, protocol.OpDelete, key, level)
+					if err != nil {
+						fmt.Println("Error talking to server:", err)
+						break
+					}
+					printReply(key, reply)
+				} else if input == "EXPIRE" {
+					fmt.Printf("Enter the TTL in seconds: ")
+					ttl := strings.TrimSpace(readLine())
+					reply, err := sendRequest(conn, protocol.OpExpire, key, ttl)
+					if err != nil {
+						fmt.Println("Error talking to server:", err)
+						break
+					}
+					printReply(key, reply)
+				} else if input == "PERSIST" {
+					reply, err := sendRequest(conn, protocol.OpPersist, key)
+					if err != nil {
+						fmt.Println("Error talking to server:", err)
+						break
+					}
+					printReply(key, reply)
+				} else if input == "CAS" || input == "SETNX" {
+					var args []string
+					op := protocol.OpSetNX
+					if input == "CAS" {
+						fmt.Printf("Enter the expected version (0 if the key must not exist): ")
+						args = append(args, key, strings.TrimSpace(readLine()))
+						op = protocol.OpCAS
 					} else {
-						parts := strings.Split(response, " ")
-						if len(parts) >= 2 {
-							fmt.Printf("Value for key %s = %s\n", key, parts[1])
-						}
+						args = append(args, key)
 					}
-				} else if input == "WRITE" {
 					fmt.Printf("Enter the value: ")
-					var new_val string
-					fmt.Scanln(&new_val)
-					fmt.Printf("Sending WRITE Operation for key %s with value %s\n", key, new_val)
-					
-					conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-					_, err := conn.Write([]byte(input + " " + key + " " + new_val))
+					args = append(args, readArg())
+					fmt.Printf("Enter the TTL in seconds (blank for none): ")
+					if ttl := strings.TrimSpace(readLine()); ttl != "" {
+						args = append(args, ttl)
+					}
+					reply, err := sendRequest(conn, op, args...)
 					if err != nil {
-						fmt.Println("Error sending request to server:", err)
+						fmt.Println("Error talking to server:", err)
 						break
 					}
-
-					buf := make([]byte, 1024)
-					conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-					n, err := conn.Read(buf) // Read response
+					printReply(key, reply)
+				} else if input == "INCRBY" || input == "DECRBY" {
+					fmt.Printf("Enter the amount: ")
+					delta := strings.TrimSpace(readLine())
+					op := protocol.OpIncrBy
+					if input == "DECRBY" {
+						op = protocol.OpDecrBy
+					}
+					reply, err := sendRequest(conn, op, key, delta)
 					if err != nil {
-						fmt.Println("Error receiving response from server:", err)
+						fmt.Println("Error talking to server:", err)
+						break
+					}
+					printReply(key, reply)
+				} else if input == "APPEND" {
+					fmt.Printf("Enter the value to append: ")
+					reply, err := sendRequest(conn, protocol.OpAppend, key, readArg())
+					if err != nil {
+						fmt.Println("Error talking to server:", err)
+						break
+					}
+					printReply(key, reply)
+				}
+			} else if input == "MGET" || input == "MSET" {
+				// Keys (and for MSET their values) are entered one per line,
+				// finished by an empty key. An MSET starts with its level.
+				var args []string
+				if input == "MSET" {
+					args = append(args, readLevel())
+				}
+				for {
+					fmt.Printf("Enter a key (blank to finish): ")
+					key := readArg()
+					if key == "" {
+						break
+					}
+					args = append(args, key)
+					if input == "MSET" {
+						fmt.Printf("Enter the value: ")
+						args = append(args, readArg())
+					}
+				}
+				if len(args) == 0 || (input == "MSET" && len(args) == 1) {
+					fmt.Println("No keys given")
+					continue
+				}
+
+				op := protocol.OpMGet
+				if input == "MSET" {
+					op = protocol.OpMSet
+				}
+				reply, err := sendRequest(conn, op, args...)
+				if err != nil {
+					fmt.Println("Error talking to server:", err)
+					break
+				}
+				results, _ := reply.Args()
+				switch {
+				case reply.Op == protocol.OpValues:
+					for i := 0; i+3 < len(results); i += 4 {
+						if results[i+1] == "1" {
+							fmt.Printf("Value for key %q = %s (version %s)\n", results[i], results[i+2], results[i+3])
+						} else {
+							fmt.Printf("Key %q not found\n", results[i])
+						}
+					}
+				case reply.Op == protocol.OpOK && op == protocol.OpMSet:
+					for i := 0; i+1 < len(results); i += 2 {
+						fmt.Printf("Key %q written at version %s\n", results[i], results[i+1])
+					}
+				default:
+					printReply("", reply)
+				}
+			} else if input == "SCAN" || input == "KEYS" {
+				// SCAN pages through keys with a prefix; KEYS lists a whole
+				// range [start, end) in one go.
+				var cursor, end, prefix, count string
+				if input == "SCAN" {
+					fmt.Printf("Enter the key prefix (blank for all keys): ")
+					prefix = readArg()
+					fmt.Printf("Enter the page size (blank for the default): ")
+					count = strings.TrimSpace(readLine())
+				} else {
+					fmt.Printf("Enter the first key of the range (blank for the start): ")
+					cursor = readArg()
+					fmt.Printf("Enter the key the range stops before (blank for the end): ")
+					end = readArg()
+				}
+
+				var err error
+				for {
+					cursor, err = scanPage(conn, cursor, end, prefix, count)
+					if err != nil || cursor == "" {
 						break
 					}
-					fmt.Printf("Server response: %s\n", string(buf[:n]))
+					if input == "SCAN" {
+						fmt.Printf("More keys after this page. Fetch the next page? (y/n): ")
+						if strings.ToLower(strings.TrimSpace(readLine())) != "y" {
+							break
+						}
+					}
+				}
+				if err != nil {
+					fmt.Println("Error talking to server:", err)
+					break
+				}
+			} else if input == "STATS" {
+				reply, err := sendRequest(conn, protocol.OpStats)
+				if err != nil {
+					fmt.Println("Error talking to server:", err)
+					break
+				}
+				stats, _ := reply.Args()
+				if reply.Op == protocol.OpOK {
+					for i := 0; i+1 < len(stats); i += 2 {
+						fmt.Printf("%s: %s\n", stats[i], stats[i+1])
+					}
+				} else {
+					printReply("", reply)
+				}
+			} else if input == "HEALTH" {
+				reply, err := sendRequest(conn, protocol.OpHealth)
+				if err != nil {
+					fmt.Println("Error talking to server:", err)
+					break
+				}
+				slaves, _ := reply.Args()
+				if reply.Op == protocol.OpOK {
+					if len(slaves) == 0 {
+						fmt.Println("No slaves")
+					}
+					for i := 0; i+3 < len(slaves); i += 4 {
+						fmt.Printf("%s  %-7s  %-21s  last heard %sms ago\n", slaves[i], slaves[i+1], slaves[i+2], slaves[i+3])
+					}
+				} else {
+					printReply("", reply)
+				}
+			} else if input == "MULTI" {
+				// Commands are queued locally and sent together on EXEC
+				var commands []string
+				for {
+					fmt.Printf("Enter a transaction command (WRITE/DELETE/CHECK, EXEC to run, DISCARD to cancel): ")
+					command := strings.ToUpper(strings.TrimSpace(readLine()))
+					if command == "EXEC" || command == "DISCARD" {
+						input = command
+						break
+					}
+					if command != "WRITE" && command != "DELETE" && command != "CHECK" {
+						fmt.Println("Invalid transaction command! Please Try Again.")
+						continue
+					}
+					fmt.Printf("Enter the key: ")
+					key := readArg()
+					value := ""
+					if command == "WRITE" {
+						fmt.Printf("Enter the value: ")
+						value = readArg()
+					} else if command == "CHECK" {
+						fmt.Printf("Enter the version the key must be at (0 if it must not exist): ")
+						value = strings.TrimSpace(readLine())
+					}
+					commands = append(commands, command, key, value)
+					fmt.Printf("Queued %s %q (%d commands)\n", command, key, len(commands)/3)
+				}
+				if input == "DISCARD" || len(commands) == 0 {
+					fmt.Println("Transaction discarded")
+					continue
+				}
+
+				reply, err := sendRequest(conn, protocol.OpExec, commands...)
+				if err != nil {
+					fmt.Println("Error talking to server:", err)
+					break
+				}
+				results, _ := reply.Args()
+				if reply.Op == protocol.OpOK {
+					fmt.Println("Transaction committed")
+					for i := 1; i+1 < len(results); i += 2 {
+						fmt.Printf("Key %q now at version %s\n", results[i], results[i+1])
+					}
+				} else if reply.Op == protocol.OpConflict && len(results) >= 1 {
+					printReply(results[0], reply)
+					fmt.Println("Transaction not applied")
+				} else {
+					printReply("", reply)
 				}
 			} else {
 				fmt.Println("Invalid Operation! Please Try Again.")
 			}
 			
 			// Check if the connection is still alive
-			conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
-			_, err := conn.Write([]byte{0}) // Send a zero byte to test connection
-			if err != nil {
+			// A REDIRECT means the server lost its leadership
+			reply, err := sendRequest(conn, protocol.OpPing)
+			if err != nil || reply.Op == protocol.OpRedirect {
 				fmt.Println("Connection lost. Attempting to reconnect...")
 				break
 			}
@@ -0,0 +1,60 @@
+package coordinator
+
+import (
+	"time"
+
+	"kvstore/oplog"
+)
+
+// Cached is what a Cache knows about a key from the log. Deleted keys stay
+// in the cache as tombstones.
+type Cached struct {
+	Value     string
+	Deleted   bool
+	ExpiresAt int64 // Unix milliseconds, 0 for no expiry
+	Version   uint64
+}
+
+// Live reports whether the cached key still has a readable value.
+func (c Cached) Live() bool {
+	return !c.Deleted && (c.ExpiresAt == 0 || time.Now().UnixMilli() < c.ExpiresAt)
+}
+
+// Cache holds what the log says about keys, so that they can be answered
+// without asking the slaves. It may forget any key at any time; a key it
+// doesn't know is read from the slaves, which keep tombstones of their own.
+// Its methods are called from many goroutines at once.
+type Cache interface {
+	Get(key string) (Cached, bool)
+	// Apply folds a WRITE, DELETE, EXPIRE or PERSIST entry into the cache,
+	// unless it already knows a newer version of the key. Other entries
+	// are ignored.
+	Apply(entry oplog.Entry)
+	// Range calls fn for every key in the cache.
+	Range(fn func(key string, cached Cached))
+	// Clear forgets every key, when the log the cache was built from is
+	// replaced.
+	Clear()
+}
+
+// cached returns what the cache knows about key, if there is a cache.
+func (kvs *KeyValueStore) cached(key string) (Cached, bool) {
+	if kvs.cache == nil {
+		return Cached{}, false
+	}
+	return kvs.cache.Get(key)
+}
+
+// forget empties the cache, if there is one.
+func (kvs *KeyValueStore) forget() {
+	if kvs.cache != nil {
+		kvs.cache.Clear()
+	}
+}
+
+// remember applies entry to the cache, if there is one.
+func (kvs *KeyValueStore) remember(entry oplog.Entry) {
+	if kvs.cache != nil {
+		kvs.cache.Apply(entry)
+	}
+}
@@ -0,0 +1,2524 @@
+// Package coordinator is the master of the key-value store: it places keys
+// on the slaves, replicates and reads them at the requested consistency,
+// keeps the slaves in sync and logs every change to kv_store.log.
+//
+// The master and the backup masters run the same coordinator and elect
+// which of them leads (see the election package); only the leader serves
+// clients and slaves, and it streams its log to the others (see
+// replication.go). A backup also keeps a Cache of what the log told it.
+package coordinator
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kvstore/election"
+	"kvstore/hlc"
+	"kvstore/merkle"
+	"kvstore/oplog"
+	"kvstore/protocol"
+	"kvstore/ring"
+)
+
+var Reset = "\033[0m" 
+var Red = "\033[31m" 
+var Green = "\033[32m" 
+var Yellow = "\033[33m" 
+var Blue = "\033[34m" 
+var Magenta = "\033[35m" 
+var Cyan = "\033[36m" 
+var Gray = "\033[37m" 
+var White = "\033[97m"
+
+// Slave is a connected slave. Any number of goroutines can have requests
+// in flight on it at once: each request gets its own ID, and a single
+// reader goroutine hands every reply to whoever is waiting for that ID.
+type Slave struct {
+	id      string // chosen by the slave, the same across reconnects
+	conn    net.Conn
+	writeMu sync.Mutex // keeps frames from interleaving on the wire
+
+	pendingMu sync.Mutex
+	pending   map[uint32]chan protocol.Frame // requests awaiting a reply, by ID
+	closed    chan struct{}                  // closed once the connection is gone
+
+	lastHeard int64 // Unix nanoseconds of the last frame from the slave, updated atomically
+	suspect   int32 // 1 while the failure detector suspects the slave, updated atomically
+	stale     int32 // 1 from rejoining until a rebalance or anti-entropy pass has caught it up, updated atomically
+}
+
+// readLast reports whether reads should try s after the other replicas:
+// while it is suspected, or still missing writes made while it was down.
+func (s *Slave) readLast() bool {
+	return atomic.LoadInt32(&s.suspect) == 1 || atomic.LoadInt32(&s.stale) == 1
+}
+
+func newSlave(id string, conn net.Conn) *Slave {
+	slave := &Slave{
+		id:      id,
+		conn:    conn,
+		pending: make(map[uint32]chan protocol.Frame),
+		closed:  make(chan struct{}),
+
+		lastHeard: time.Now().UnixNano(),
+	}
+	go slave.readReplies()
+	return slave
+}
+
+// readReplies routes every frame the slave sends to the request it answers
+// until the connection fails.
+func (s *Slave) readReplies() {
+	defer close(s.closed)
+	for {
+		frame, err := protocol.ReadFrame(s.conn)
+		if err != nil {
+			fmt.Printf(Red+"Slave connection closed: %v\n"+Reset, err)
+			return
+		}
+		atomic.StoreInt64(&s.lastHeard, time.Now().UnixNano())
+		if frame.Op == protocol.OpPing {
+			// Keepalive sent by the slave while it was idle; it wants to
+			// hear back that we are still here
+			s.writeMu.Lock()
+			s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			protocol.WriteFrame(s.conn, protocol.Frame{Op: protocol.OpPong, ReqID: frame.ReqID})
+			s.writeMu.Unlock()
+			continue
+		}
+		if frame.Op == protocol.OpPong {
+			// Answer to a heartbeat; hearing it is all that matters
+			continue
+		}
+
+		s.pendingMu.Lock()
+		reply, waiting := s.pending[frame.ReqID]
+		delete(s.pending, frame.ReqID)
+		s.pendingMu.Unlock()
+
+		if !waiting {
+			// Late reply to a request that already timed out
+			fmt.Printf(Yellow+"Discarding stale reply %d from slave\n"+Reset, frame.ReqID)
+			continue
+		}
+		reply <- frame
+	}
+}
+
+// ping sends the slave a heartbeat. Its PONG, like any other frame from
+// the slave, shows up in lastHeard.
+func (s *Slave) ping() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(heartbeatInterval))
+	protocol.WriteFrame(s.conn, protocol.Frame{Op: protocol.OpPing})
+}
+
+// silence is how long it has been since the slave last sent anything.
+func (s *Slave) silence() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastHeard)))
+}
+
+// requestIDs hands out the IDs stamped on frames sent to slaves
+var requestIDs uint32
+
+func checkPortInUse(port string) bool {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return true
+	}
+	ln.Close()
+	return false
+}
+
+// keyLockStripes is how many mutexes guard read-modify-write operations;
+// every key hashes onto one of them.
+const keyLockStripes = 256
+
+type KeyValueStore struct {
+	slaves        []*Slave
+	ring          *ring.Ring        // node IDs of the connected slaves, changed under slaveMutex along with slaves
+	versions      map[string]uint64 // latest version handed out per key, for up to maxTrackedKeys keys, guarded by versionMux
+	clock         hlc.Clock         // stamps versions, see nextVersion
+	repairs       repairStats
+	syncs         antiEntropyStats
+	rebalanced    rebalanceStats
+	rebalanceCh   chan struct{} // signalled when slaves join or leave the ring
+	ringMoved     uint64        // clock time of the last ring change no rebalance has caught up with, 0 for none; accessed atomically
+	hintMutex     sync.Mutex
+	hints         map[string][]hint    // requests missed by unreachable slaves, by slave ID, guarded by hintMutex
+	downSince     map[string]time.Time // when each unreachable slave was removed, guarded by hintMutex
+	hinted        hintStats
+	slaveMutex    sync.Mutex
+	versionMux    sync.Mutex
+	keyLocks      [keyLockStripes]sync.Mutex
+	txnMutex      sync.Mutex
+	committedTxns map[string]bool          // transactions logged as committed that a slave may still hold prepared, guarded by txnMutex
+	activeTxns    map[string]chan struct{} // transactions between prepare and commit, closed when settled
+	cache         Cache                    // what the log says about keys, nil for none
+	dataDir       string                   // holds kv_store.log and election.state
+	logFile       *os.File
+	logMutex      sync.Mutex
+	logTail       string   // hash of the last entry in the log (see logHash), guarded by logMutex
+	leaderConn    net.Conn // the leader's replication stream, while we follow, guarded by logMutex
+	election      *election.Node
+	logSeq        uint64 // entries in kv_store.log, guarded by logMutex
+	logTerm       uint64 // term of the last entry in kv_store.log, guarded by logMutex
+	backupMutex   sync.Mutex
+	backups       []*backupLink // backups the log is being replicated to, guarded by backupMutex
+	backupAcked   *sync.Cond    // broadcast under backupMutex when a backup acknowledges entries
+}
+
+// NewKeyValueStore returns a store keeping its log in dataDir ("" for the
+// working directory) and answering from cache, if not nil.
+func NewKeyValueStore(dataDir string, cache Cache) *KeyValueStore {
+	// Open log file for writing
+	logFile, err := os.OpenFile(filepath.Join(dataDir, "kv_store.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Printf(Red+"Error opening log file: %v\n"+Reset, err)
+	}
+	
+	kvs := &KeyValueStore{
+		slaves:        make([]*Slave, 0),
+		ring:          ring.New(virtualNodes),
+		versions:      make(map[string]uint64),
+		hints:         make(map[string][]hint),
+		rebalanceCh:   make(chan struct{}, 1),
+		downSince:     make(map[string]time.Time),
+		committedTxns: make(map[string]bool),
+		activeTxns:    make(map[string]chan struct{}),
+		cache:         cache,
+		dataDir:       dataDir,
+		logFile:       logFile,
+	}
+	kvs.backupAcked = sync.NewCond(&kvs.backupMutex)
+	return kvs
+}
+
+// lockKey serialises changes to key (writes, deletes, CAS) and returns the
+// function that releases the lock.
+func (kvs *KeyValueStore) lockKey(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &kvs.keyLocks[h.Sum32()%keyLockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// lockKeys takes the locks for several keys at once. Stripes are locked in
+// ascending order so two batches can never deadlock each other.
+func (kvs *KeyValueStore) lockKeys(keys []string) func() {
+	stripes := make(map[uint32]bool)
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		stripes[h.Sum32()%keyLockStripes] = true
+	}
+	order := make([]int, 0, len(stripes))
+	for stripe := range stripes {
+		order = append(order, int(stripe))
+	}
+	sort.Ints(order)
+
+	for _, stripe := range order {
+		kvs.keyLocks[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range order {
+			kvs.keyLocks[stripe].Unlock()
+		}
+	}
+}
+
+// nextVersion returns the version to stamp on the next change to key: a
+// hybrid logical clock timestamp past both the wall clock and any version
+// of the key seen so far. Callers hold the key lock.
+func (kvs *KeyValueStore) nextVersion(key string) uint64 {
+	kvs.versionMux.Lock()
+	version, known := kvs.versions[key]
+	kvs.versionMux.Unlock()
+
+	if !known {
+		latest, _ := kvs.fetchLatest(key)
+		version = latest.Version
+	}
+	kvs.clock.Observe(version)
+	return kvs.clock.Now()
+}
+
+// recordVersion notes version as the latest of key. Only maxTrackedKeys
+// keys are remembered; forgetting one is safe, as the clock has observed its
+// version and nextVersion asks the slaves about keys it doesn't know. A
+// version of 0 only says the slaves asked had never held the key, so it is
+// not kept: the key stays unknown and is asked about again.
+func (kvs *KeyValueStore) recordVersion(key string, version uint64) {
+	if version == 0 {
+		return
+	}
+	kvs.versionMux.Lock()
+	current, ok := kvs.versions[key]
+	if !ok {
+		evictOne(kvs.versions, maxTrackedKeys)
+	}
+	if !ok || version > current {
+		kvs.versions[key] = version
+	}
+	kvs.versionMux.Unlock()
+	kvs.clock.Observe(version)
+}
+
+// evictOne makes room for one more key in m if it already holds limit keys
+// (limit <= 0 means no limit). The key dropped is whichever map iteration
+// yields first, which is random.
+func evictOne[V any](m map[string]V, limit int) {
+	if limit <= 0 || len(m) < limit {
+		return
+	}
+	for key := range m {
+		delete(m, key)
+		return
+	}
+}
+
+func (kvs *KeyValueStore) closeResources() {
+	if kvs.logFile != nil {
+		kvs.logFile.Close()
+	}
+}
+
+// logOperation appends entry to the log and returns its sequence number,
+// 0 if it could not be written or our leader lease has lapsed. A change
+// that wasn't logged must not be reported as done.
+func (kvs *KeyValueStore) logOperation(entry oplog.Entry) uint64 {
+	if kvs.logFile == nil {
+		return 0
+	}
+	kvs.logMutex.Lock()
+	// A leader without a lease may have been replaced already, and the new
+	// leader would never receive the entry
+	if !kvs.election.HoldsLease() {
+		kvs.logMutex.Unlock()
+		fmt.Printf(Red+"Not logging %s %q: leadership not confirmed by a majority of masters\n"+Reset, entry.Op, entry.Key)
+		return 0
+	}
+	entry.Term = kvs.election.State().Term
+	logEntry := oplog.Format(entry) + "\n"
+	_, err := kvs.logFile.WriteString(logEntry)
+	if err != nil {
+		kvs.logMutex.Unlock()
+		fmt.Printf(Red+"Error writing to log file: %v\n"+Reset, err)
+		return 0
+	}
+	kvs.logFile.Sync() // Ensure data is written to disk
+	kvs.logSeq++
+	kvs.logTail = logHash(oplog.Format(entry))
+	kvs.logTerm = entry.Term
+	seq := kvs.logSeq
+	kvs.logMutex.Unlock()
+
+	kvs.logGrew()
+	return seq
+}
+
+func (kvs *KeyValueStore) sendRequestToSlave(slave *Slave, op protocol.Op, args []string, timeout time.Duration) (protocol.Frame, error) {
+	reqID := atomic.AddUint32(&requestIDs, 1)
+	reply := make(chan protocol.Frame, 1)
+
+	slave.pendingMu.Lock()
+	slave.pending[reqID] = reply
+	slave.pendingMu.Unlock()
+	defer func() {
+		slave.pendingMu.Lock()
+		delete(slave.pending, reqID)
+		slave.pendingMu.Unlock()
+	}()
+
+	slave.writeMu.Lock()
+	slave.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := protocol.WriteFrame(slave.conn, protocol.NewFrame(op, reqID, args...))
+	slave.writeMu.Unlock()
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case frame := <-reply:
+		fmt.Printf(Green+"Received valid response from a slave: %s\n", frame.Op.String()+Reset)
+		return frame, nil
+	case <-slave.closed:
+		return protocol.Frame{}, fmt.Errorf("slave connection closed")
+	case <-timer.C:
+		return protocol.Frame{}, fmt.Errorf("slave did not answer %s within %v", op, timeout)
+	}
+}
+
+// sendRequestsToAllSlaves sends the request to every connected slave. The
+// slice is copied under slaveMutex, since removeSlave shifts it in place.
+func (kvs *KeyValueStore) sendRequestsToAllSlaves(op protocol.Op, args []string, timeout time.Duration) map[*Slave]protocol.Frame {
+	kvs.slaveMutex.Lock()
+	slaves := slices.Clone(kvs.slaves)
+	kvs.slaveMutex.Unlock()
+	return kvs.sendRequestsToSlaves(slaves, op, args, timeout)
+}
+
+// sendRequestsToSlaves sends the same request to each of slaves in parallel
+// and collects the replies of those that answered.
+func (kvs *KeyValueStore) sendRequestsToSlaves(slaves []*Slave, op protocol.Op, args []string, timeout time.Duration) map[*Slave]protocol.Frame {
+	responses := make(map[*Slave]protocol.Frame)
+	var wg sync.WaitGroup
+
+	for _, slave := range slaves {
+		wg.Add(1)
+		go func(s *Slave) {
+			defer wg.Done()
+			response, err := kvs.sendRequestToSlave(s, op, args, timeout)
+			if err == nil {
+				kvs.slaveMutex.Lock()
+				responses[s] = response
+				kvs.slaveMutex.Unlock()
+			}
+		}(slave)
+	}
+
+	wg.Wait()
+	return responses
+}
+
+// receiveAckFromSlaves sends the request to each of slaves in parallel and
+// reports for every one of them whether it acknowledged with OK.
+func (kvs *KeyValueStore) receiveAckFromSlaves(slaves []*Slave, op protocol.Op, args []string, timeout time.Duration) map[*Slave]bool {
+	responses := kvs.sendRequestsToSlaves(slaves, op, args, timeout)
+
+	acks := make(map[*Slave]bool, len(slaves))
+	for _, slave := range slaves {
+		acks[slave] = responses[slave].Op == protocol.OpOK
+	}
+	return acks
+}
+
+// handleWrite writes key at the given consistency level and returns its
+// new version and how many replicas acknowledged.
+func (kvs *KeyValueStore) handleWrite(key, value string, expiresAt int64, level string) (uint64, int, error) {
+	unlock := kvs.lockKey(key)
+	defer unlock()
+
+	version := kvs.nextVersion(key)
+	acked, err := kvs.applyWrite(key, value, expiresAt, version, level)
+	return version, acked, err
+}
+
+// replicas returns the connected slaves that hold key, in order of
+// preference: replicationFactor of them, or a majority of the connected
+// slaves if no factor is set, placed by the ring. Every master that knows
+// the same slaves picks the same ones, and nothing is kept per key.
+func (kvs *KeyValueStore) replicas(key string) []*Slave {
+	kvs.slaveMutex.Lock()
+	defer kvs.slaveMutex.Unlock()
+
+	owners := kvs.ring.Lookup(key, kvs.replicaCount())
+	replicas := make([]*Slave, 0, len(owners))
+	for _, id := range owners {
+		if slave := kvs.slaveByID(id); slave != nil {
+			replicas = append(replicas, slave)
+		}
+	}
+	// Suspected slaves go last, so reads don't wait on a slave that has
+	// gone quiet while it is given time to come back. So do rejoined ones
+	// until they have caught up, so reads don't find their old copies.
+	slices.SortStableFunc(replicas, func(a, b *Slave) int {
+		switch {
+		case a.readLast() == b.readLast():
+			return 0
+		case a.readLast():
+			return 1
+		}
+		return -1
+	})
+	return replicas
+}
+
+// replicaCount is how many replicas every key has: replicationFactor, or a
+// majority of the slaves on the ring if no factor is set.
+func (kvs *KeyValueStore) replicaCount() int {
+	if replicationFactor > 0 {
+		return replicationFactor
+	}
+	return int(math.Ceil(float64(kvs.ring.Len()+1) * 0.5))
+}
+
+// slaveByID returns the connected slave with node ID id, the latest
+// connection if it has several, or nil. Callers hold slaveMutex.
+func (kvs *KeyValueStore) slaveByID(id string) *Slave {
+	for i := len(kvs.slaves) - 1; i >= 0; i-- {
+		if kvs.slaves[i].id == id {
+			return kvs.slaves[i]
+		}
+	}
+	return nil
+}
+
+// Cluster-wide replication settings, set from the command line.
+var (
+	replicationFactor int    // N: replicas per key, 0 for a majority of the connected slaves
+	virtualNodes      int    // points per slave on the ring; must match on every master
+	rebalanceRate     int    // most keys per second copied when slaves join or leave, 0 for none
+	readLevel         string // R used by reads that don't ask for a level
+	writeLevel        string // W used by writes that don't ask for a level
+
+	hintWindow time.Duration // how long after a slave goes down requests are kept for it
+	maxHints   int           // most requests kept for one slave
+
+	maxTrackedKeys int // most keys whose latest version is kept in memory
+
+	heartbeatInterval time.Duration // how often every slave is pinged, 0 for never
+	suspectAfter      time.Duration // silence after which a slave is suspected
+	downAfter         time.Duration // silence after which a slave is declared down and dropped
+
+	syncInterval time.Duration // how often the slaves are compared and synced, 0 for never
+)
+
+// Where this master sits among the others, set from the command line.
+var (
+	self     string // address at which the others reach us, "" for localhost and our port
+	peerList string // every master in the cluster, comma separated
+)
+
+// RegisterFlags defines the command-line flags every master takes on the
+// default flag set. Call it before flag.Parse.
+func RegisterFlags() {
+	flag.IntVar(&replicationFactor, "n", 3, "Replicas per key (0 for a majority of the connected slaves)")
+	flag.IntVar(&virtualNodes, "vnodes", ring.VNodes, "Points per slave on the hash ring; use the same on every master")
+	flag.StringVar(&readLevel, "r", "ONE", "Default read consistency: ONE, QUORUM, ALL or a replica count")
+	flag.StringVar(&writeLevel, "w", "QUORUM", "Default write consistency: ONE, QUORUM, ALL or a replica count")
+	flag.DurationVar(&hintWindow, "hint-window", time.Hour, "How long requests missed by an unreachable slave are kept for it")
+	flag.IntVar(&maxHints, "max-hints", 10000, "Most requests kept for one unreachable slave")
+	flag.IntVar(&maxTrackedKeys, "max-tracked-keys", 100000, "Most keys whose latest version (and on backups, value) is kept in memory (0 for no limit)")
+	flag.IntVar(&rebalanceRate, "rebalance-rate", 1000, "Most keys per second copied to new replicas when slaves join or leave (0 to disable)")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", time.Second, "How often every slave is pinged (0 to disable failure detection)")
+	flag.DurationVar(&suspectAfter, "suspect-after", 3*time.Second, "Silence after which a slave is suspected and read from last")
+	flag.DurationVar(&downAfter, "down-after", 10*time.Second, "Silence after which a slave is declared down and dropped")
+	flag.DurationVar(&syncInterval, "anti-entropy", 30*time.Second, "How often the slaves are compared and synced (0 to disable)")
+	flag.StringVar(&self, "self", "", "Address at which the other masters, clients and slaves reach this one (default localhost:<port>)")
+	flag.StringVar(&peerList, "peers", "localhost:12345,localhost:12346,localhost:12347,localhost:12348", "Every master in the cluster, this one included, comma separated")
+}
+
+// MaxTrackedKeys is the most keys whose latest version is kept in memory,
+// which also bounds a cache (0 for no limit).
+func MaxTrackedKeys() int { return maxTrackedKeys }
+
+// requiredReplicas turns a consistency level into how many replicas must
+// answer: ONE, QUORUM, ALL or an explicit count. QUORUM and ALL are taken
+// of the replication factor, so they don't get weaker as slaves drop out;
+// only without one are they taken of the n replicas there are. A request
+// that can't reach that many replicas fails.
+func requiredReplicas(level string, n int) (int, error) {
+	if replicationFactor > 0 {
+		n = replicationFactor
+	}
+	switch level {
+	case "ONE":
+		return 1, nil
+	case "QUORUM":
+		return n/2 + 1, nil
+	case "ALL":
+		return max(n, 1), nil
+	}
+	count, err := strconv.Atoi(level)
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("invalid consistency level %q", level)
+	}
+	return count, nil
+}
+
+// optionalLevel reads the consistency level at args[i], falling back to
+// def if the client didn't send one.
+func optionalLevel(args []string, i int, def string) (string, error) {
+	if len(args) <= i || args[i] == "" {
+		return def, nil
+	}
+	level := strings.ToUpper(args[i])
+	if _, err := requiredReplicas(level, 1); err != nil {
+		return "", err
+	}
+	return level, nil
+}
+
+// writeToReplicas sends the WRITE args to the replicas of key not in tried
+// and returns those that acknowledged. A replica that fails is removed,
+// which takes it off the ring, so the next slave along the ring stands in
+// for it. That goes on for as long as there are slaves not yet tried, so
+// the key keeps its full set of copies where possible. Every slave written
+// to is added to tried.
+func (kvs *KeyValueStore) writeToReplicas(key string, args []string, tried map[*Slave]bool) []*Slave {
+	var acked []*Slave
+	for {
+		var pending []*Slave
+		for _, slave := range kvs.replicas(key) {
+			if !tried[slave] {
+				pending = append(pending, slave)
+			}
+		}
+		if len(pending) == 0 {
+			return acked
+		}
+
+		acks := kvs.receiveAckFromSlaves(pending, protocol.OpWrite, args, 3*time.Second)
+		failed := 0
+		for _, slave := range pending {
+			tried[slave] = true
+			if acks[slave] {
+				acked = append(acked, slave)
+			} else {
+				failed++
+				kvs.removeSlave(slave)
+				kvs.storeHint(slave, protocol.OpWrite, args)
+			}
+		}
+		if failed == 0 {
+			return acked
+		}
+		fmt.Printf(Red+"No acknowledgment received from %d slave(s). Removing them and trying substitutes.\n"+Reset, failed)
+	}
+}
+
+// applyWrite replicates one versioned write and logs it, returning how many
+// of the key's slaves acknowledged. If fewer than level requires did, the
+// write stays wherever it landed but an error says it fell short. Callers
+// hold the key lock.
+func (kvs *KeyValueStore) applyWrite(key, value string, expiresAt int64, version uint64, level string) (int, error) {
+	replicas := kvs.replicas(key)
+	needed, err := requiredReplicas(level, len(replicas))
+	if err != nil {
+		return 0, err
+	}
+	if len(replicas) < needed {
+		fmt.Printf(Red+"Write of %q refused: %d of %d required replicas connected.\n"+Reset, key, len(replicas), needed)
+		return 0, fmt.Errorf("only %d of %d required replicas are connected", len(replicas), needed)
+	}
+
+	args := []string{key, value, strconv.FormatInt(expiresAt, 10), strconv.FormatUint(version, 10)}
+	acked := kvs.writeToReplicas(key, args, make(map[*Slave]bool))
+
+	// A write no replica took exists nowhere, so it is neither logged nor
+	// reported as done, whatever the level
+	if len(acked) == 0 {
+		fmt.Printf(Red+"Write of %q reached no replica.\n"+Reset, key)
+		return 0, fmt.Errorf("no replica acknowledged the write")
+	}
+	entry := oplog.Entry{Op: "WRITE", Key: key, Value: value, ExpiresAt: expiresAt, Version: version}
+	kvs.remember(entry)
+	kvs.recordVersion(key, version)
+	if kvs.logOperation(entry) == 0 {
+		return len(acked), fmt.Errorf("the write could not be logged; try again")
+	}
+
+	if len(acked) < needed {
+		fmt.Printf(Red+"Write of %q reached %d of %d required replicas.\n"+Reset, key, len(acked), needed)
+		return len(acked), fmt.Errorf("only %d of %d required replicas acknowledged", len(acked), needed)
+	}
+	fmt.Printf(Magenta+"Write operation successful.\n"+Reset)
+	return len(acked), nil
+}
+
+// handleRead reads key at the given consistency level. Deleted and expired
+// keys in the cache are answered from it too, so a slave that still has an
+// old copy cannot bring them back. Reads at ONE stop there; stronger reads
+// still go to the slaves, and the cache only wins if it is newer than what
+// they hold.
+func (kvs *KeyValueStore) handleRead(key, level string) (readResult, error) {
+	cached, exists := kvs.cached(key)
+	if exists && (level == "ONE" || level == "1") {
+		return readResult{value: cached.Value, version: cached.Version, found: cached.Live()}, nil
+	}
+
+	result, err := kvs.readFromSlaves(key, level)
+	if exists && cached.Version >= result.version {
+		result.value, result.version, result.found = cached.Value, cached.Version, cached.Live()
+	}
+	return result, err
+}
+
+// readFromSlaves reads key at the given consistency level from its replicas.
+// With ONE the first replica that answers decides; otherwise that many
+// replicas must answer and the highest version among them wins. If none of
+// them has ever held the key, every slave is asked, but only if the ring
+// has changed since the key could have been written (see mayHaveMoved).
+func (kvs *KeyValueStore) readFromSlaves(key, level string) (readResult, error) {
+	replicas := kvs.replicas(key)
+	needed, err := requiredReplicas(level, len(replicas))
+	if err != nil {
+		return readResult{}, err
+	}
+	if len(replicas) < needed {
+		return readResult{}, fmt.Errorf("only %d of %d required replicas are connected", len(replicas), needed)
+	}
+
+	if needed <= 1 {
+		for _, slave := range replicas {
+			response, err := kvs.sendRequestToSlave(slave, protocol.OpRead, []string{key}, 3*time.Second)
+			if err != nil {
+				continue
+			}
+			if response.Op != protocol.OpValue {
+				// A tombstone settles it; a replica that never held the
+				// key only does if the key can't have been put elsewhere.
+				if args, err := response.Args(); err == nil && len(args) >= 2 && (args[1] != "0" || !kvs.mayHaveMoved(key)) {
+					return readResult{replicas: 1}, nil
+				}
+				break
+			}
+			args, err := response.Args()
+			if err != nil || len(args) < 3 {
+				continue
+			}
+			version, _ := strconv.ParseUint(args[2], 10, 64)
+			return readResult{value: args[1], version: version, found: true, replicas: 1}, nil
+		}
+		return kvs.readFromAllSlaves(key), nil
+	}
+
+	var newest readResult
+	var expiresAt int64
+	held := make(map[*Slave]uint64)
+	responses := kvs.sendRequestsToSlaves(replicas, protocol.OpRead, []string{key}, 3*time.Second)
+	for slave, response := range responses {
+		args, err := response.Args()
+		if err != nil || len(args) < 2 {
+			continue
+		}
+		newest.replicas++
+		switch {
+		case response.Op == protocol.OpValue && len(args) >= 3:
+			version, _ := strconv.ParseUint(args[2], 10, 64)
+			held[slave] = version
+			if version >= newest.version {
+				newest.value, newest.version, newest.found = args[1], version, true
+				expiresAt = 0
+				if len(args) >= 4 {
+					expiresAt, _ = strconv.ParseInt(args[3], 10, 64)
+				}
+			}
+		case response.Op == protocol.OpNotFound:
+			// Replicas missing the key answer with version 0 and get
+			// repaired like any other stale copy.
+			version, _ := strconv.ParseUint(args[1], 10, 64)
+			held[slave] = version
+			if version > newest.version {
+				newest.value, newest.version, newest.found = "", version, false
+			}
+		}
+	}
+	if newest.replicas > 0 && newest.version == 0 && kvs.mayHaveMoved(key) {
+		return kvs.readFromAllSlaves(key), nil
+	}
+	kvs.scheduleRepair(newest.entry(key, expiresAt), held)
+	if newest.replicas < needed {
+		return newest, fmt.Errorf("only %d of %d required replicas answered", newest.replicas, needed)
+	}
+	return newest, nil
+}
+
+// readFromAllSlaves looks for key on every slave and settles on the copy
+// with the highest version. Replicas that lack it are repaired.
+func (kvs *KeyValueStore) readFromAllSlaves(key string) readResult {
+	var newest readResult
+	var expiresAt int64
+	held := make(map[*Slave]uint64)
+	replicas := kvs.replicas(key)
+
+	fmt.Printf(Yellow+"No replica has held %q, asking every slave\n\n"+Reset, key)
+	slaveResponses := kvs.sendRequestsToAllSlaves(protocol.OpRead, []string{key}, 3*time.Second)
+	for slave, response := range slaveResponses {
+		args, err := response.Args()
+		if err != nil || len(args) < 2 {
+			continue
+		}
+		newest.replicas++
+		switch {
+		case response.Op == protocol.OpValue && len(args) >= 3:
+			version, _ := strconv.ParseUint(args[2], 10, 64)
+			held[slave] = version
+			if version > newest.version || version == newest.version && !newest.found {
+				newest.value, newest.version, newest.found = args[1], version, true
+				expiresAt = 0
+				if len(args) >= 4 {
+					expiresAt, _ = strconv.ParseInt(args[3], 10, 64)
+				}
+			}
+		case response.Op == protocol.OpNotFound:
+			// A tombstone newer than every value means the key is gone.
+			// Slaves that never held the key are left out of the repair
+			// unless they are its replicas.
+			version, _ := strconv.ParseUint(args[1], 10, 64)
+			if version > 0 || slices.Contains(replicas, slave) {
+				held[slave] = version
+			}
+			if version > newest.version {
+				newest.value, newest.version, newest.found = "", version, false
+			}
+		}
+	}
+	kvs.recordVersion(key, newest.version)
+	kvs.scheduleRepair(newest.entry(key, expiresAt), held)
+	return newest
+}
+
+// readResult is the answer for one key of a READ or MGET.
+type readResult struct {
+	value    string
+	version  uint64
+	found    bool
+	replicas int // how many replicas answered
+}
+
+// entry turns r into the change that brings a replica of key up to date.
+func (r readResult) entry(key string, expiresAt int64) oplog.Entry {
+	if !r.found {
+		return oplog.Entry{Op: "DELETE", Key: key, Version: r.version}
+	}
+	return oplog.Entry{Op: "WRITE", Key: key, Value: r.value, ExpiresAt: expiresAt, Version: r.version}
+}
+
+// repairStats counts read repairs since startup. Fields are updated
+// atomically.
+type repairStats struct {
+	scheduled uint64 // stale replicas found by reads
+	repaired  uint64 // stale replicas brought up to date
+	failed    uint64 // stale replicas that did not take the repair
+}
+
+// scheduleRepair pushes newest in the background to every slave in held,
+// which maps the replicas a read heard from to the version each holds,
+// whose copy is older.
+func (kvs *KeyValueStore) scheduleRepair(newest oplog.Entry, held map[*Slave]uint64) {
+	var stale []*Slave
+	for slave, version := range held {
+		if version < newest.Version {
+			stale = append(stale, slave)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	atomic.AddUint64(&kvs.repairs.scheduled, uint64(len(stale)))
+	go kvs.repair(newest, stale)
+}
+
+// repair writes newest to the stale slaves. Slaves never replace a copy
+// with an older version, so a repair that arrives after a newer write to
+// the key changes nothing.
+func (kvs *KeyValueStore) repair(newest oplog.Entry, stale []*Slave) {
+	op := protocol.OpWrite
+	args := []string{newest.Key, newest.Value, strconv.FormatInt(newest.ExpiresAt, 10), strconv.FormatUint(newest.Version, 10)}
+	if newest.Op == "DELETE" {
+		op = protocol.OpDelete
+		args = []string{newest.Key, strconv.FormatUint(newest.Version, 10)}
+	}
+
+	// A repaired DELETE answers NOT_FOUND if the old copy had expired, so
+	// any reply counts.
+	responses := kvs.sendRequestsToSlaves(stale, op, args, 3*time.Second)
+	for _, slave := range stale {
+		if _, ok := responses[slave]; !ok || responses[slave].Op == protocol.OpError {
+			atomic.AddUint64(&kvs.repairs.failed, 1)
+			continue
+		}
+		atomic.AddUint64(&kvs.repairs.repaired, 1)
+	}
+	fmt.Printf(Yellow+"Read repair of %q at version %d: %d of %d stale replicas answered\n"+Reset, newest.Key, newest.Version, len(responses), len(stale))
+}
+
+// hint is a request a slave missed while it was unreachable, kept to be
+// replayed when it reconnects.
+type hint struct {
+	op       protocol.Op
+	args     []string
+	storedAt time.Time
+}
+
+// hintStats counts hinted handoff since startup. Fields are updated
+// atomically.
+type hintStats struct {
+	stored   uint64
+	dropped  uint64 // not stored, or expired before the slave came back
+	replayed uint64
+}
+
+// storeHint keeps a request that slave, just removed, did not acknowledge.
+// Hints are only kept for hintWindow after a slave goes down and at most
+// maxHints per slave; past that the slave has to be caught up by
+// anti-entropy instead.
+func (kvs *KeyValueStore) storeHint(slave *Slave, op protocol.Op, args []string) {
+	if slave.id == "" {
+		return
+	}
+	kvs.hintMutex.Lock()
+	defer kvs.hintMutex.Unlock()
+
+	if time.Since(kvs.downSince[slave.id]) > hintWindow || len(kvs.hints[slave.id]) >= maxHints {
+		atomic.AddUint64(&kvs.hinted.dropped, 1)
+		return
+	}
+	kvs.hints[slave.id] = append(kvs.hints[slave.id], hint{op: op, args: args, storedAt: time.Now()})
+	atomic.AddUint64(&kvs.hinted.stored, 1)
+}
+
+// replayHints sends a reconnecting slave, in order, the requests it missed.
+// If the slave fails again, the hints not yet delivered are kept for its
+// next attempt.
+func (kvs *KeyValueStore) replayHints(slave *Slave) error {
+	kvs.hintMutex.Lock()
+	hints := kvs.hints[slave.id]
+	delete(kvs.hints, slave.id)
+	delete(kvs.downSince, slave.id)
+	kvs.hintMutex.Unlock()
+
+	replayed := 0
+	for i, h := range hints {
+		if time.Since(h.storedAt) > hintWindow {
+			atomic.AddUint64(&kvs.hinted.dropped, 1)
+			continue
+		}
+		if _, err := kvs.sendRequestToSlave(slave, h.op, h.args, 3*time.Second); err != nil {
+			kvs.hintMutex.Lock()
+			kvs.hints[slave.id] = append(hints[i:], kvs.hints[slave.id]...)
+			kvs.downSince[slave.id] = time.Now()
+			kvs.hintMutex.Unlock()
+			return err
+		}
+		replayed++
+		atomic.AddUint64(&kvs.hinted.replayed, 1)
+	}
+	if replayed > 0 {
+		fmt.Printf(Green+"Replayed %d hinted request(s) to slave %s\n"+Reset, replayed, slave.id)
+	}
+	return nil
+}
+
+// expireHints forgets the slaves that have been down for longer than
+// hintWindow, along with the hints kept for them, which would only be
+// dropped on replay. A slave that comes back after that is caught up by the
+// rebalance its return sets off, or by anti-entropy.
+func (kvs *KeyValueStore) expireHints() {
+	kvs.hintMutex.Lock()
+	defer kvs.hintMutex.Unlock()
+	for id, since := range kvs.downSince {
+		if time.Since(since) <= hintWindow {
+			continue
+		}
+		atomic.AddUint64(&kvs.hinted.dropped, uint64(len(kvs.hints[id])))
+		delete(kvs.hints, id)
+		delete(kvs.downSince, id)
+		fmt.Printf(Yellow+"Slave %s has been down for over %v; forgetting it\n"+Reset, id, hintWindow)
+	}
+}
+
+// stats lists counters for the STATS command as name, value pairs.
+func (kvs *KeyValueStore) stats() []string {
+	stats := []string{
+		"read_repairs_scheduled", strconv.FormatUint(atomic.LoadUint64(&kvs.repairs.scheduled), 10),
+		"read_repairs_done", strconv.FormatUint(atomic.LoadUint64(&kvs.repairs.repaired), 10),
+		"read_repairs_failed", strconv.FormatUint(atomic.LoadUint64(&kvs.repairs.failed), 10),
+		"anti_entropy_rounds", strconv.FormatUint(atomic.LoadUint64(&kvs.syncs.rounds), 10),
+		"anti_entropy_leaves", strconv.FormatUint(atomic.LoadUint64(&kvs.syncs.leaves), 10),
+		"anti_entropy_keys", strconv.FormatUint(atomic.LoadUint64(&kvs.syncs.keys), 10),
+		"rebalance_runs", strconv.FormatUint(atomic.LoadUint64(&kvs.rebalanced.runs), 10),
+		"rebalance_keys", strconv.FormatUint(atomic.LoadUint64(&kvs.rebalanced.keys), 10),
+		"hints_stored", strconv.FormatUint(atomic.LoadUint64(&kvs.hinted.stored), 10),
+		"hints_dropped", strconv.FormatUint(atomic.LoadUint64(&kvs.hinted.dropped), 10),
+		"hints_replayed", strconv.FormatUint(atomic.LoadUint64(&kvs.hinted.replayed), 10),
+	}
+	return append(stats, kvs.replicationStats()...)
+}
+
+// antiEntropyStats counts the work of the anti-entropy process since
+// startup. Fields are updated atomically.
+type antiEntropyStats struct {
+	rounds uint64 // comparisons of every partition's replicas
+	leaves uint64 // Merkle leaves found to differ
+	keys   uint64 // copies written to slaves that were behind
+}
+
+// antiEntropy brings the slaves back in line with each other every
+// interval, catching up the ones that missed writes while away.
+func (kvs *KeyValueStore) antiEntropy(interval time.Duration) {
+	for range time.Tick(interval) {
+		kvs.syncSlaves()
+	}
+}
+
+// syncSlaves brings the replicas of every partition of the ring (see
+// ring.Partitions) in line with each other. The slaves holding a partition
+// each hash their keys in it into a Merkle tree, so replicas in sync have
+// identical trees. The trees are compared level by level, descending only
+// into nodes on which they disagree, and the keys of the leaves that differ
+// are read from those slaves. The newest copy of each key is written to the
+// slaves that hold an older one, and to its replicas that lack it.
+func (kvs *KeyValueStore) syncSlaves() {
+	kvs.slaveMutex.Lock()
+	byID := make(map[string]*Slave, len(kvs.slaves))
+	for _, slave := range kvs.slaves {
+		byID[slave.id] = slave
+	}
+	kvs.slaveMutex.Unlock()
+	if len(byID) < 2 {
+		return
+	}
+	atomic.AddUint64(&kvs.syncs.rounds, 1)
+
+	// Slaves keep the trees of the round they were last asked about, so
+	// every round needs a name no earlier one had
+	round := strconv.FormatInt(time.Now().UnixNano(), 36)
+	synced := 0
+	for _, part := range kvs.ring.Partitions(kvs.replicaCount()) {
+		var owners []*Slave
+		for _, id := range part.Owners {
+			if slave := byID[id]; slave != nil {
+				owners = append(owners, slave)
+			}
+		}
+		if len(owners) < 2 {
+			continue
+		}
+		ranges := ring.FormatRanges(part.Ranges)
+		compared, leaves := kvs.differingLeaves(owners, round, ranges)
+		for _, slave := range owners {
+			if !slices.Contains(compared, slave) {
+				delete(byID, slave.id)
+			}
+		}
+		owners = compared
+		if len(leaves) == 0 {
+			continue
+		}
+		atomic.AddUint64(&kvs.syncs.leaves, uint64(len(leaves)))
+		synced += kvs.syncLeaves(owners, ranges, leaves)
+	}
+
+	atomic.AddUint64(&kvs.syncs.keys, uint64(synced))
+	if synced > 0 {
+		fmt.Printf(Yellow+"Anti-entropy: %d stale keys updated\n"+Reset, synced)
+	}
+
+	// Slaves compared on every partition they hold are caught up
+	var compared []*Slave
+	for _, slave := range byID {
+		compared = append(compared, slave)
+	}
+	caughtUp(compared)
+}
+
+// caughtUp lets reads go to rejoined slaves first again once a pass over
+// all their data has brought them up to date.
+func caughtUp(slaves []*Slave) {
+	for _, slave := range slaves {
+		if atomic.CompareAndSwapInt32(&slave.stale, 1, 0) {
+			fmt.Printf(Green+"Slave %s has caught up\n"+Reset, slave.id)
+		}
+	}
+}
+
+// differingLeaves walks the Merkle trees the slaves build over ranges in
+// the given round down to the leaves on which they disagree. It returns
+// the slaves that answered throughout, and those leaves.
+func (kvs *KeyValueStore) differingLeaves(slaves []*Slave, round, ranges string) ([]*Slave, []int) {
+	nodes := []int{0}
+	for level := 0; ; level++ {
+		args := []string{round, ranges, strconv.Itoa(level)}
+		for _, node := range nodes {
+			args = append(args, strconv.Itoa(node))
+		}
+		responses := kvs.sendRequestsToSlaves(slaves, protocol.OpHashes, args, 3*time.Second)
+
+		// Slaves that don't answer sit out the rest of the round
+		hashes := make(map[*Slave][]string)
+		for slave, response := range responses {
+			values, err := response.Args()
+			if response.Op == protocol.OpOK && err == nil && len(values) == len(nodes) {
+				hashes[slave] = values
+			}
+		}
+		slaves = slices.DeleteFunc(slaves, func(slave *Slave) bool { return hashes[slave] == nil })
+		if len(slaves) < 2 {
+			return slaves, nil
+		}
+
+		var differing []int
+		for i, node := range nodes {
+			for _, slave := range slaves[1:] {
+				if hashes[slave][i] != hashes[slaves[0]][i] {
+					differing = append(differing, node)
+					break
+				}
+			}
+		}
+		if len(differing) == 0 || level == merkle.Depth {
+			return slaves, differing
+		}
+
+		nodes = nodes[:0]
+		for _, node := range differing {
+			for child := node * merkle.Fanout; child < (node+1)*merkle.Fanout; child++ {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+}
+
+// syncLeaves reads the keys in ranges ("" for all keys) of the given Merkle
+// leaves from every slave in slaves and writes the newest copy of each key
+// to the slaves that hold an older one, and to its replicas that lack it.
+// It returns how many copies were written.
+func (kvs *KeyValueStore) syncLeaves(slaves []*Slave, ranges string, nodes []int) int {
+	args := []string{ranges}
+	for _, leaf := range nodes {
+		args = append(args, strconv.Itoa(leaf))
+	}
+	responses := kvs.sendRequestsToSlaves(slaves, protocol.OpBucket, args, 3*time.Second)
+
+	newest := make(map[string]oplog.Entry)
+	held := make(map[string]map[*Slave]uint64)
+	for slave, response := range responses {
+		values, err := response.Args()
+		if response.Op != protocol.OpOK || err != nil {
+			continue
+		}
+		for i := 0; i+4 < len(values); i += 5 {
+			key := values[i]
+			expiresAt, _ := strconv.ParseInt(values[i+3], 10, 64)
+			version, _ := strconv.ParseUint(values[i+4], 10, 64)
+			if held[key] == nil {
+				held[key] = make(map[*Slave]uint64)
+			}
+			held[key][slave] = version
+			if current, seen := newest[key]; !seen || version > current.Version {
+				if values[i+1] == "1" {
+					newest[key] = oplog.Entry{Op: "WRITE", Key: key, Value: values[i+2], ExpiresAt: expiresAt, Version: version}
+				} else {
+					newest[key] = oplog.Entry{Op: "DELETE", Key: key, Version: version}
+				}
+			}
+		}
+	}
+
+	// Per slave, the live copies go out as one MSET and tombstones as
+	// DELETEs; slaves ignore anything older than what they hold.
+	writes := make(map[*Slave][]string)
+	deletes := make(map[*Slave][]oplog.Entry)
+	for key, entry := range newest {
+		kvs.recordVersion(key, entry.Version)
+
+		behind := make(map[*Slave]bool)
+		for slave, version := range held[key] {
+			if version < entry.Version {
+				behind[slave] = true
+			}
+		}
+		if entry.Op == "WRITE" {
+			for _, replica := range kvs.replicas(key) {
+				if _, holds := held[key][replica]; !holds && slices.Contains(slaves, replica) {
+					behind[replica] = true
+				}
+			}
+		}
+
+		for slave := range behind {
+			if entry.Op == "WRITE" {
+				writes[slave] = append(writes[slave], key, entry.Value, strconv.FormatInt(entry.ExpiresAt, 10), strconv.FormatUint(entry.Version, 10))
+			} else {
+				deletes[slave] = append(deletes[slave], entry)
+			}
+		}
+	}
+
+	var synced int64
+	var wg sync.WaitGroup
+	for _, slave := range slaves {
+		if len(writes[slave]) == 0 && len(deletes[slave]) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(slave *Slave) {
+			defer wg.Done()
+			if len(writes[slave]) > 0 {
+				response, err := kvs.sendRequestToSlave(slave, protocol.OpMSet, writes[slave], 5*time.Second)
+				if err == nil && response.Op == protocol.OpOK {
+					atomic.AddInt64(&synced, int64(len(writes[slave])/4))
+				}
+			}
+			for _, entry := range deletes[slave] {
+				_, err := kvs.sendRequestToSlave(slave, protocol.OpDelete, []string{entry.Key, strconv.FormatUint(entry.Version, 10)}, 3*time.Second)
+				if err == nil {
+					atomic.AddInt64(&synced, 1)
+				}
+			}
+		}(slave)
+	}
+	wg.Wait()
+	return int(synced)
+}
+
+// rebalanceStats counts the data moved after slaves joined or left since
+// startup. Fields are updated atomically.
+type rebalanceStats struct {
+	runs uint64 // passes over all the slaves' data
+	keys uint64 // copies written to replicas that lacked them
+}
+
+const (
+	rebalanceLeaves = 16              // Merkle leaves moved per step
+	rebalanceDelay  = 2 * time.Second // wait for more changes before starting
+	rebalancePause  = 100 * time.Millisecond
+)
+
+// ringChanged tells the rebalancer that slaves joined or left the ring.
+func (kvs *KeyValueStore) ringChanged() {
+	atomic.StoreUint64(&kvs.ringMoved, kvs.clock.Now())
+	select {
+	case kvs.rebalanceCh <- struct{}{}:
+	default:
+	}
+}
+
+// rebalancer runs a rebalance after every change to the ring. Changes that
+// come close together, such as every slave reconnecting after a master
+// restart, are handled by a single pass.
+func (kvs *KeyValueStore) rebalancer() {
+	for range kvs.rebalanceCh {
+		time.Sleep(rebalanceDelay)
+		select {
+		case <-kvs.rebalanceCh:
+		default:
+		}
+		kvs.rebalance()
+	}
+}
+
+// rebalance goes through the data of every slave, a few Merkle leaves at a
+// time, and copies each key to those of its replicas on the ring that lack
+// it or hold an older copy. A slave that joined thereby receives the keys
+// it is now a replica of, and keys that lost a replica when a slave left
+// get a new copy on the next slave along the ring. Copies on slaves that
+// are no longer replicas are left alone; reads take the newest version
+// wherever it is.
+//
+// Copying is throttled to rebalanceRate keys per second, with a pause
+// after every step, so client requests aren't starved. If the ring changes
+// again, the pass stops and a new one starts over.
+func (kvs *KeyValueStore) rebalance() {
+	moved := atomic.LoadUint64(&kvs.ringMoved)
+	kvs.slaveMutex.Lock()
+	slaves := slices.Clone(kvs.slaves)
+	kvs.slaveMutex.Unlock()
+	if len(slaves) < 2 {
+		// A lone slave has nothing to catch up from
+		caughtUp(slaves)
+		atomic.CompareAndSwapUint64(&kvs.ringMoved, moved, 0)
+		return
+	}
+	atomic.AddUint64(&kvs.rebalanced.runs, 1)
+	fmt.Printf(Yellow+"Rebalancing data over %d slaves\n"+Reset, len(slaves))
+
+	copied := 0
+	for first := 0; first < merkle.Leaves; first += rebalanceLeaves {
+		if len(kvs.rebalanceCh) > 0 {
+			fmt.Printf(Yellow+"Slaves changed again, restarting the rebalance\n"+Reset)
+			return
+		}
+		leaves := make([]int, 0, rebalanceLeaves)
+		for leaf := first; leaf < min(first+rebalanceLeaves, merkle.Leaves); leaf++ {
+			leaves = append(leaves, leaf)
+		}
+		n := kvs.syncLeaves(slaves, "", leaves)
+		atomic.AddUint64(&kvs.rebalanced.keys, uint64(n))
+		copied += n
+		time.Sleep(rebalancePause + time.Duration(n)*time.Second/time.Duration(rebalanceRate))
+	}
+	fmt.Printf(Green+"Rebalance done: %d keys copied to their replicas\n"+Reset, copied)
+	caughtUp(slaves)
+	// Every key is now on its replicas, unless the ring moved again
+	atomic.CompareAndSwapUint64(&kvs.ringMoved, moved, 0)
+}
+
+// mayHaveMoved reports whether key may be held by slaves other than its
+// replicas: the ring changed after its latest version we know of (or at
+// all, if we know none) and no rebalance has caught up since. Only then
+// does a replica that has never held key not settle that it is absent.
+func (kvs *KeyValueStore) mayHaveMoved(key string) bool {
+	moved := atomic.LoadUint64(&kvs.ringMoved)
+	if moved == 0 {
+		return false
+	}
+	kvs.versionMux.Lock()
+	version, known := kvs.versions[key]
+	kvs.versionMux.Unlock()
+	return !known || version < moved
+}
+
+// handleMGet reads many keys at once. Keys are grouped by their first
+// replica and each slave gets a single batched request, all in parallel.
+// Keys whose replica did not answer, or has never held them, go through
+// handleRead one by one (also in parallel). Keys in the cache are answered
+// from it, as handleRead does.
+func (kvs *KeyValueStore) handleMGet(keys []string) []readResult {
+	results := make([]readResult, len(keys))
+	resolved := make([]bool, len(keys))
+	for i, key := range keys {
+		if cached, ok := kvs.cached(key); ok {
+			results[i] = readResult{value: cached.Value, version: cached.Version, found: cached.Live()}
+			resolved[i] = true
+		}
+	}
+
+	batches := make(map[*Slave][]string)
+	for i, key := range keys {
+		if replicas := kvs.replicas(key); !resolved[i] && len(replicas) > 0 {
+			batches[replicas[0]] = append(batches[replicas[0]], key)
+		}
+	}
+
+	answers := make(map[string]readResult)
+	var answersMux sync.Mutex
+	var wg sync.WaitGroup
+	for slave, batch := range batches {
+		wg.Add(1)
+		go func(slave *Slave, batch []string) {
+			defer wg.Done()
+			response, err := kvs.sendRequestToSlave(slave, protocol.OpMGet, batch, 3*time.Second)
+			if err != nil || response.Op != protocol.OpValues {
+				return
+			}
+			args, err := response.Args()
+			if err != nil {
+				return
+			}
+			answersMux.Lock()
+			defer answersMux.Unlock()
+			for i := 0; i+3 < len(args); i += 4 {
+				version, _ := strconv.ParseUint(args[i+3], 10, 64)
+				answers[args[i]] = readResult{value: args[i+2], version: version, found: args[i+1] == "1"}
+			}
+		}(slave, batch)
+	}
+	wg.Wait()
+
+	for i, key := range keys {
+		if resolved[i] {
+			continue
+		}
+		if answer, ok := answers[key]; ok && (answer.found || answer.version > 0) {
+			results[i] = answer
+			continue
+		}
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			results[i], _ = kvs.handleRead(key, readLevel)
+		}(i, key)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// handleMSet writes several keys as one batch: every key is locked and
+// versioned up front, then each slave gets a single MSET frame carrying the
+// keys it owns, all in parallel. A key whose replica failed is then
+// written to substitutes one by one, as applyWrite does. A key given twice
+// keeps its last value. It returns the version each key ended up at, and
+// an error if any key fell short of level.
+func (kvs *KeyValueStore) handleMSet(pairs []string, level string) (map[string]uint64, error) {
+	var keys, values []string
+	position := make(map[string]int)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if j, seen := position[pairs[i]]; seen {
+			values[j] = pairs[i+1]
+			continue
+		}
+		position[pairs[i]] = len(keys)
+		keys = append(keys, pairs[i])
+		values = append(values, pairs[i+1])
+	}
+
+	unlock := kvs.lockKeys(keys)
+	defer unlock()
+
+	// Keys the master hasn't seen yet need a round trip to learn their
+	// current version; do those concurrently.
+	versions := make([]uint64, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			versions[i] = kvs.nextVersion(key)
+		}(i, key)
+	}
+	wg.Wait()
+
+	// A key that can't reach the write level fails the whole batch before
+	// anything is sent
+	owners := make([][]*Slave, len(keys))
+	batches := make(map[*Slave][]string)
+	for i, key := range keys {
+		owners[i] = kvs.replicas(key)
+		needed, err := requiredReplicas(level, len(owners[i]))
+		if err != nil {
+			return nil, err
+		}
+		if len(owners[i]) < needed {
+			return nil, fmt.Errorf("only %d of %d required replicas of %q are connected", len(owners[i]), needed, key)
+		}
+		for _, slave := range owners[i] {
+			batches[slave] = append(batches[slave], key, values[i], "0", strconv.FormatUint(versions[i], 10))
+		}
+	}
+
+	acks := make(map[*Slave]bool)
+	var acksMux sync.Mutex
+	for slave, batch := range batches {
+		wg.Add(1)
+		go func(slave *Slave, batch []string) {
+			defer wg.Done()
+			response, err := kvs.sendRequestToSlave(slave, protocol.OpMSet, batch, 3*time.Second)
+			acksMux.Lock()
+			acks[slave] = err == nil && response.Op == protocol.OpOK
+			acksMux.Unlock()
+		}(slave, batch)
+	}
+	wg.Wait()
+
+	for slave, acked := range acks {
+		if !acked {
+			kvs.removeSlave(slave)
+			kvs.storeHint(slave, protocol.OpMSet, batches[slave])
+		}
+	}
+
+	// Keys a replica failed to take go to substitutes, as in applyWrite
+	acked := make([][]*Slave, len(keys))
+	for i, key := range keys {
+		tried := make(map[*Slave]bool)
+		for _, slave := range owners[i] {
+			tried[slave] = true
+			if acks[slave] {
+				acked[i] = append(acked[i], slave)
+			}
+		}
+		if len(acked[i]) == len(owners[i]) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, key string, tried map[*Slave]bool) {
+			defer wg.Done()
+			args := []string{key, values[i], "0", strconv.FormatUint(versions[i], 10)}
+			acked[i] = append(acked[i], kvs.writeToReplicas(key, args, tried)...)
+		}(i, key, tried)
+	}
+	wg.Wait()
+
+	var shortfall error
+	result := make(map[string]uint64, len(keys))
+	for i, key := range keys {
+		needed, _ := requiredReplicas(level, len(owners[i]))
+		if len(acked[i]) < needed && shortfall == nil {
+			shortfall = fmt.Errorf("only %d of %d required replicas acknowledged %q", len(acked[i]), needed, key)
+		}
+		if len(acked[i]) > 0 {
+			entry := oplog.Entry{Op: "WRITE", Key: key, Value: values[i], Version: versions[i]}
+			kvs.remember(entry)
+			kvs.recordVersion(key, versions[i])
+			if kvs.logOperation(entry) == 0 && shortfall == nil {
+				shortfall = fmt.Errorf("the write of %q could not be logged; try again", key)
+			}
+		}
+		result[key] = versions[i]
+	}
+
+	if shortfall != nil {
+		fmt.Printf(Red+"MSET of %d keys fell short: %v\n"+Reset, len(keys), shortfall)
+		return result, shortfall
+	}
+	fmt.Printf(Magenta+"MSET of %d keys successful.\n"+Reset, len(keys))
+	return result, nil
+}
+
+// defaultScanCount and maxScanCount bound how many keys one SCAN returns.
+const (
+	defaultScanCount = 10
+	maxScanCount     = 1000
+)
+
+// handleScan returns, in key order, up to limit live keys that are >= start,
+// < end (if end is set) and carry prefix, plus the cursor to pass as start
+// for the next page ("" once the range is exhausted).
+//
+// Every slave returns its own first limit keys, tombstones included, and
+// the newest version of each key wins. A slave that filled its page may
+// hold more keys past its last one, so the page only reaches as far as the
+// smallest such last key; beyond it another slave's copy could be missing.
+func (kvs *KeyValueStore) handleScan(start, end, prefix string, limit int) ([]oplog.Entry, string) {
+	if start < prefix {
+		start = prefix
+	}
+	responses := kvs.sendRequestsToAllSlaves(protocol.OpScan, []string{start, end, prefix, strconv.Itoa(limit)}, 3*time.Second)
+
+	newest := make(map[string]oplog.Entry)
+	live := make(map[string]bool)
+	merge := func(entry oplog.Entry, isLive bool) {
+		if current, seen := newest[entry.Key]; !seen || entry.Version > current.Version {
+			newest[entry.Key] = entry
+			live[entry.Key] = isLive
+		}
+	}
+
+	var bound string
+	bounded := false
+	for _, response := range responses {
+		args, err := response.Args()
+		if err != nil || response.Op != protocol.OpValues {
+			continue
+		}
+		count := 0
+		for i := 0; i+3 < len(args); i += 4 {
+			version, _ := strconv.ParseUint(args[i+3], 10, 64)
+			merge(oplog.Entry{Key: args[i], Value: args[i+2], Version: version}, args[i+1] == "1")
+			count++
+		}
+		if count == limit && count > 0 && (!bounded || args[len(args)-4] < bound) {
+			bound = args[len(args)-4]
+			bounded = true
+		}
+	}
+
+	// The cache only adds keys the log mentioned, and newer copies, to
+	// what the slaves returned, so it never limits how far the page reaches.
+	if kvs.cache != nil {
+		kvs.cache.Range(func(key string, cached Cached) {
+			if key >= start && (end == "" || key < end) && strings.HasPrefix(key, prefix) {
+				merge(oplog.Entry{Key: key, Value: cached.Value, Version: cached.Version}, cached.Live())
+			}
+		})
+	}
+
+	keys := make([]string, 0, len(newest))
+	for key := range newest {
+		if live[key] && (!bounded || key <= bound) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// The smallest key after k is k followed by a zero byte
+	cursor := ""
+	if len(keys) > limit {
+		keys = keys[:limit]
+		cursor = keys[limit-1] + "\x00"
+	} else if bounded {
+		cursor = bound + "\x00"
+	}
+
+	page := make([]oplog.Entry, len(keys))
+	for i, key := range keys {
+		page[i] = newest[key]
+	}
+	return page, cursor
+}
+
+// fetchLatest asks the replicas of key for it, or every slave if the key
+// may have moved (see mayHaveMoved), and returns the newest copy by version
+// and whether that copy is live. Callers hold the key lock.
+func (kvs *KeyValueStore) fetchLatest(key string) (oplog.Entry, bool) {
+	var responses map[*Slave]protocol.Frame
+	if kvs.mayHaveMoved(key) {
+		responses = kvs.sendRequestsToAllSlaves(protocol.OpRead, []string{key}, 3*time.Second)
+	} else {
+		responses = kvs.sendRequestsToSlaves(kvs.replicas(key), protocol.OpRead, []string{key}, 3*time.Second)
+	}
+
+	latest := oplog.Entry{Key: key}
+	live := false
+	for _, response := range responses {
+		args, err := response.Args()
+		if err != nil {
+			continue
+		}
+		switch {
+		case response.Op == protocol.OpValue && len(args) >= 4:
+			version, _ := strconv.ParseUint(args[2], 10, 64)
+			if version > latest.Version {
+				expiresAt, _ := strconv.ParseInt(args[3], 10, 64)
+				latest = oplog.Entry{Key: key, Value: args[1], ExpiresAt: expiresAt, Version: version}
+				live = true
+			}
+		case response.Op == protocol.OpNotFound && len(args) >= 2:
+			version, _ := strconv.ParseUint(args[1], 10, 64)
+			if version > latest.Version {
+				latest = oplog.Entry{Key: key, Version: version}
+				live = false
+			}
+		}
+	}
+
+	// The log may know about a newer change than any slave we can reach
+	if cached, ok := kvs.cached(key); ok && cached.Version > latest.Version {
+		latest = oplog.Entry{Key: key, Value: cached.Value, ExpiresAt: cached.ExpiresAt, Version: cached.Version}
+		live = cached.Live()
+	}
+
+	kvs.recordVersion(key, latest.Version)
+	return latest, live
+}
+
+// handleCAS writes value only if key is currently at version expected, 0
+// meaning the key must not exist (which is how SETNX is served). It returns
+// the key's version afterwards and whether the write happened.
+func (kvs *KeyValueStore) handleCAS(key string, expected uint64, value string, expiresAt int64) (uint64, bool, error) {
+	unlock := kvs.lockKey(key)
+	defer unlock()
+
+	latest, live := kvs.fetchLatest(key)
+	current := latest.Version
+	if !live {
+		current = 0
+	}
+	if current != expected {
+		fmt.Printf(Red+"CAS on %q failed: expected version %d, found %d\n"+Reset, key, expected, current)
+		return current, false, nil
+	}
+
+	version := kvs.nextVersion(key)
+	_, err := kvs.applyWrite(key, value, expiresAt, version, writeLevel)
+	return version, true, err
+}
+
+// handleUpdate runs a read-modify-write (INCRBY, DECRBY, APPEND) on key
+// atomically: the key lock is held from reading the newest copy until the
+// result has been replicated and logged as a plain WRITE. The key's TTL, if
+// it has one, is kept.
+func (kvs *KeyValueStore) handleUpdate(key string, update func(current string, exists bool) (string, error)) (oplog.Entry, error) {
+	unlock := kvs.lockKey(key)
+	defer unlock()
+
+	latest, live := kvs.fetchLatest(key)
+	if !live {
+		latest = oplog.Entry{Key: key}
+	}
+	value, err := update(latest.Value, live)
+	if err != nil {
+		return oplog.Entry{}, err
+	}
+
+	version := kvs.nextVersion(key)
+	_, err = kvs.applyWrite(key, value, latest.ExpiresAt, version, writeLevel)
+	return oplog.Entry{Op: "WRITE", Key: key, Value: value, ExpiresAt: latest.ExpiresAt, Version: version}, err
+}
+
+// incrementBy returns the update for INCRBY/DECRBY. A missing key counts
+// as 0; anything that isn't a decimal int64 is refused.
+func incrementBy(delta int64) func(string, bool) (string, error) {
+	return func(current string, exists bool) (string, error) {
+		var n int64
+		if exists {
+			var err error
+			if n, err = strconv.ParseInt(current, 10, 64); err != nil {
+				return "", fmt.Errorf("value is not an integer")
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return "", fmt.Errorf("increment would overflow")
+		}
+		return strconv.FormatInt(n+delta, 10), nil
+	}
+}
+
+// txnIDs numbers the transactions started by this process
+var txnIDs uint32
+
+// newTxnID returns an ID no other master process will hand out.
+func newTxnID() string {
+	return fmt.Sprintf("%x-%d", time.Now().UnixNano(), atomic.AddUint32(&txnIDs, 1))
+}
+
+// txnConflict is returned by handleExec when a CHECK does not hold.
+type txnConflict struct {
+	key     string
+	version uint64
+}
+
+func (c txnConflict) Error() string {
+	return fmt.Sprintf("key %q is at version %d", c.key, c.version)
+}
+
+// handleExec runs a transaction given as op, key, value triples: WRITE key
+// value, DELETE key, or CHECK key version, which makes the whole
+// transaction conditional on key being at that version beforehand. It
+// returns the changes made, with their new versions.
+//
+// The replicas of every key it changes prepare the changes first. Only
+// when all of them have is the transaction logged as one TXN record, which
+// is the commit point, and then committed on them. If any of them fails to
+// prepare the transaction is aborted and nothing is logged. A transaction
+// with a key that has no replica connected is refused outright.
+func (kvs *KeyValueStore) handleExec(commands []string) ([]oplog.Entry, error) {
+	if len(commands) == 0 || len(commands)%3 != 0 {
+		return nil, fmt.Errorf("a transaction is a list of op, key, value triples")
+	}
+	keys := make([]string, 0, len(commands)/3)
+	for i := 0; i < len(commands); i += 3 {
+		switch commands[i] {
+		case "WRITE", "DELETE", "CHECK":
+		default:
+			return nil, fmt.Errorf("%s is not allowed in a transaction", commands[i])
+		}
+		keys = append(keys, commands[i+1])
+	}
+
+	unlock := kvs.lockKeys(keys)
+	defer unlock()
+
+	var ops []oplog.Entry
+	assigned := make(map[string]uint64)
+	for i := 0; i < len(commands); i += 3 {
+		op, key, value := commands[i], commands[i+1], commands[i+2]
+		if op == "CHECK" {
+			expected, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version %q", value)
+			}
+			latest, live := kvs.fetchLatest(key)
+			current := latest.Version
+			if !live {
+				current = 0
+			}
+			if current != expected {
+				return nil, txnConflict{key: key, version: current}
+			}
+			continue
+		}
+
+		// A key changed twice in one transaction gets a new version each time
+		version, seen := assigned[key]
+		if seen {
+			version = kvs.clock.Now()
+		} else {
+			version = kvs.nextVersion(key)
+		}
+		assigned[key] = version
+		if op == "DELETE" {
+			value = ""
+		}
+		ops = append(ops, oplog.Entry{Op: op, Key: key, Value: value, Version: version})
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	txnID := newTxnID()
+	settled := make(chan struct{})
+	kvs.txnMutex.Lock()
+	kvs.activeTxns[txnID] = settled
+	kvs.txnMutex.Unlock()
+	defer func() {
+		kvs.txnMutex.Lock()
+		delete(kvs.activeTxns, txnID)
+		kvs.txnMutex.Unlock()
+		close(settled)
+	}()
+
+	prepare := []string{txnID}
+	for _, op := range ops {
+		prepare = append(prepare, op.Op, op.Key, op.Value, strconv.FormatInt(op.ExpiresAt, 10), strconv.FormatUint(op.Version, 10))
+	}
+
+	// A change none of its key's replicas holds would commit nowhere, so
+	// every key needs a replica, and all of them must prepare
+	var participants []*Slave
+	for _, op := range ops {
+		replicas := kvs.replicas(op.Key)
+		if len(replicas) == 0 {
+			fmt.Printf(Red+"Transaction %s refused: no replica of %q is connected\n"+Reset, txnID, op.Key)
+			return nil, fmt.Errorf("no replica of %q is connected", op.Key)
+		}
+		for _, replica := range replicas {
+			if !slices.Contains(participants, replica) {
+				participants = append(participants, replica)
+			}
+		}
+	}
+
+	responses := kvs.sendRequestsToSlaves(participants, protocol.OpPrepare, prepare, 3*time.Second)
+	var prepared, failed []*Slave
+	for _, slave := range participants {
+		if response, ok := responses[slave]; ok && response.Op == protocol.OpOK {
+			prepared = append(prepared, slave)
+		} else {
+			failed = append(failed, slave)
+		}
+	}
+	if len(failed) > 0 {
+		kvs.sendRequestsToSlaves(prepared, protocol.OpAbort, []string{txnID}, 3*time.Second)
+		for _, slave := range failed {
+			kvs.removeSlave(slave)
+		}
+		fmt.Printf(Red+"Transaction %s aborted: %d slave(s) did not prepare\n"+Reset, txnID, len(failed))
+		return nil, fmt.Errorf("transaction aborted: %d slave(s) did not prepare", len(failed))
+	}
+
+	// Logging the transaction commits it: from here on every slave will
+	// apply it, if not on our COMMIT then when it reconnects to whichever
+	// master is up. The followers get a moment to receive it for that.
+	seq := kvs.logOperation(oplog.Entry{Op: "TXN", Key: txnID, Value: oplog.FormatTxn(ops)})
+	if seq == 0 {
+		// Without its TXN record the transaction never committed
+		kvs.sendRequestsToSlaves(prepared, protocol.OpAbort, []string{txnID}, 3*time.Second)
+		fmt.Printf(Red+"Transaction %s aborted: it could not be logged\n"+Reset, txnID)
+		return nil, fmt.Errorf("transaction aborted: it could not be logged")
+	}
+	if !kvs.awaitBackups(seq, 2*time.Second) {
+		fmt.Printf(Yellow+"Not every follower confirmed transaction %s in time\n"+Reset, txnID)
+	}
+	kvs.txnMutex.Lock()
+	kvs.committedTxns[txnID] = true
+	kvs.txnMutex.Unlock()
+
+	for _, op := range ops {
+		kvs.applyLogEntry(op)
+	}
+
+	responses = kvs.sendRequestsToSlaves(participants, protocol.OpCommit, []string{txnID}, 3*time.Second)
+	committed := true
+	for _, slave := range participants {
+		if response, ok := responses[slave]; !ok || response.Op != protocol.OpOK {
+			kvs.removeSlave(slave)
+			committed = false
+		}
+	}
+	// Once every participant has committed, none can report the
+	// transaction prepared again, so there is no need to remember it
+	if committed {
+		kvs.txnMutex.Lock()
+		delete(kvs.committedTxns, txnID)
+		kvs.txnMutex.Unlock()
+	}
+
+	fmt.Printf(Magenta+"Transaction %s committed (%d changes).\n"+Reset, txnID, len(ops))
+	return ops, nil
+}
+
+// resolvePendingTxns settles the transactions a reconnecting slave still
+// holds prepared: logged ones are committed, the rest aborted. A
+// transaction still in progress here is waited for first.
+func (kvs *KeyValueStore) resolvePendingTxns(slave *Slave, txnIDs []string) {
+	for _, txnID := range txnIDs {
+		kvs.txnMutex.Lock()
+		settled, active := kvs.activeTxns[txnID]
+		kvs.txnMutex.Unlock()
+		if active {
+			<-settled
+		}
+
+		kvs.txnMutex.Lock()
+		committed := kvs.committedTxns[txnID]
+		kvs.txnMutex.Unlock()
+
+		op := protocol.OpAbort
+		if committed {
+			op = protocol.OpCommit
+		}
+		fmt.Printf(Yellow+"Prepared transaction %s on reconnecting slave: %s\n"+Reset, txnID, op)
+		kvs.sendRequestToSlave(slave, op, []string{txnID}, 3*time.Second)
+	}
+}
+
+// broadcastKeyUpdate sends a key-level change (delete, expire, persist) to
+// every slave, not just the key's replicas, so no copy is left behind
+// for a fallback read to find. It reports whether any slave held a live
+// value for the key, and how many slaves there were and how many applied the
+// update.
+func (kvs *KeyValueStore) broadcastKeyUpdate(op protocol.Op, args []string) (bool, int, int) {
+	kvs.slaveMutex.Lock()
+	slaves := append([]*Slave(nil), kvs.slaves...)
+	kvs.slaveMutex.Unlock()
+
+	responses := kvs.sendRequestsToSlaves(slaves, op, args, 3*time.Second)
+
+	existed := false
+	notReceivedSlaves := make([]*Slave, 0)
+	for _, slave := range slaves {
+		response, ok := responses[slave]
+		if !ok {
+			notReceivedSlaves = append(notReceivedSlaves, slave)
+		} else if response.Op == protocol.OpOK {
+			existed = true
+		}
+	}
+	acked := len(slaves) - len(notReceivedSlaves)
+
+	// A slave that missed the update would serve the old state on a later
+	// fallback read, so it is dropped just like on a failed write.
+	if len(notReceivedSlaves) > 0 {
+		fmt.Printf(Red+"No acknowledgment received from some slaves. Removing them.\n"+Reset)
+		for _, slave := range notReceivedSlaves {
+			kvs.removeSlave(slave)
+			kvs.storeHint(slave, op, args)
+		}
+	}
+	return existed, len(slaves), acked
+}
+
+// handleDelete removes key at the given consistency level, counted against
+// all slaves since they all get the tombstone. It reports whether the key
+// existed and how many slaves acknowledged.
+func (kvs *KeyValueStore) handleDelete(key, level string) (bool, int, error) {
+	unlock := kvs.lockKey(key)
+	defer unlock()
+
+	kvs.slaveMutex.Lock()
+	connected := len(kvs.slaves)
+	kvs.slaveMutex.Unlock()
+	if needed, err := requiredReplicas(level, connected); err != nil || connected < needed {
+		if err == nil {
+			err = fmt.Errorf("only %d of %d required replicas are connected", connected, needed)
+		}
+		return false, 0, err
+	}
+
+	version := kvs.nextVersion(key)
+	existed, total, acked := kvs.broadcastKeyUpdate(protocol.OpDelete, []string{key, strconv.FormatUint(version, 10)})
+	if acked == 0 {
+		fmt.Printf(Red+"Delete of %q reached no replica.\n"+Reset, key)
+		return false, 0, fmt.Errorf("no replica acknowledged the delete")
+	}
+	if cached, ok := kvs.cached(key); ok && cached.Live() {
+		existed = true
+	}
+	entry := oplog.Entry{Op: "DELETE", Key: key, Version: version}
+	kvs.remember(entry)
+	kvs.recordVersion(key, version)
+
+	if kvs.logOperation(entry) == 0 {
+		return existed, acked, fmt.Errorf("the delete could not be logged; try again")
+	}
+
+	needed, err := requiredReplicas(level, total)
+	if err == nil && acked < needed {
+		err = fmt.Errorf("only %d of %d required replicas acknowledged", acked, needed)
+	}
+	if err != nil {
+		return existed, acked, err
+	}
+	fmt.Printf(Magenta+"Delete operation successful.\n"+Reset)
+	return existed, acked, nil
+}
+
+// handleExpire sets (or with expiresAt 0, clears) the deadline of an
+// existing key. It reports whether the key was there to update, and an
+// error if the change could not be logged.
+//
+// Like any other change the new deadline gets a version of its own, so
+// replicas that missed it are found and repaired. Slaves only apply it to
+// the newest copy of the value, the one it was made for.
+func (kvs *KeyValueStore) handleExpire(key string, expiresAt int64) (bool, error) {
+	unlock := kvs.lockKey(key)
+	defer unlock()
+
+	latest, live := kvs.fetchLatest(key)
+	if !live {
+		return false, nil
+	}
+	version := kvs.nextVersion(key)
+	stamp := []string{strconv.FormatUint(version, 10), strconv.FormatUint(latest.Version, 10)}
+
+	var existed bool
+	operation := "EXPIRE"
+	if expiresAt == 0 {
+		operation = "PERSIST"
+		existed, _, _ = kvs.broadcastKeyUpdate(protocol.OpPersist, append([]string{key}, stamp...))
+	} else {
+		existed, _, _ = kvs.broadcastKeyUpdate(protocol.OpExpire, append([]string{key, strconv.FormatInt(expiresAt, 10)}, stamp...))
+	}
+
+	if cached, ok := kvs.cached(key); ok && cached.Live() {
+		existed = true
+	}
+
+	if existed {
+		entry := oplog.Entry{Op: operation, Key: key, ExpiresAt: expiresAt, Version: version}
+		kvs.remember(entry)
+		kvs.recordVersion(key, version)
+		if kvs.logOperation(entry) == 0 {
+			return true, fmt.Errorf("the change could not be logged; try again")
+		}
+	}
+	return existed, nil
+}
+
+// optionalExpiry reads the TTL at args[i], if the client sent one.
+func optionalExpiry(args []string, i int) (int64, error) {
+	if len(args) <= i || args[i] == "" {
+		return 0, nil
+	}
+	return ttlToExpiry(args[i])
+}
+
+// ttlToExpiry turns a TTL in seconds from a client into an absolute
+// deadline in Unix milliseconds.
+func ttlToExpiry(ttl string) (int64, error) {
+	seconds, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid TTL %q", ttl)
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second).UnixMilli(), nil
+}
+
+// detectFailures pings every slave each heartbeatInterval and judges it by
+// how long it has gone without sending anything. A slave silent for
+// suspectAfter is suspected: it stays a replica, but reads try it last. One
+// silent for downAfter is declared down and dropped as if its connection
+// had failed, so its keys move on along the ring and the requests it misses
+// are kept for it until it reconnects, or for hintWindow.
+func (kvs *KeyValueStore) detectFailures() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		kvs.expireHints()
+
+		kvs.slaveMutex.Lock()
+		slaves := slices.Clone(kvs.slaves)
+		kvs.slaveMutex.Unlock()
+
+		for _, slave := range slaves {
+			silent := slave.silence()
+			switch {
+			case silent >= downAfter:
+				fmt.Printf(Red+"Slave %s is DOWN: nothing heard for %v\n"+Reset, slave.id, silent.Round(time.Millisecond))
+				kvs.removeSlave(slave)
+				continue
+			case silent >= suspectAfter:
+				if atomic.CompareAndSwapInt32(&slave.suspect, 0, 1) {
+					fmt.Printf(Yellow+"Slave %s is SUSPECT: nothing heard for %v\n"+Reset, slave.id, silent.Round(time.Millisecond))
+				}
+			default:
+				if atomic.CompareAndSwapInt32(&slave.suspect, 1, 0) {
+					fmt.Printf(Green+"Slave %s is UP again\n"+Reset, slave.id)
+				}
+			}
+			go slave.ping()
+		}
+	}
+}
+
+// health lists every slave the master knows of for the HEALTH command as
+// node ID, state, address and milliseconds since it was last heard from,
+// sorted by ID. For a slave that is down, the time counts from when it was
+// dropped; one down for longer than hintWindow is no longer listed.
+func (kvs *KeyValueStore) health() []string {
+	type slaveHealth struct {
+		id, state, addr string
+		silence         time.Duration
+	}
+	var slaves []slaveHealth
+
+	kvs.slaveMutex.Lock()
+	for _, slave := range kvs.slaves {
+		state := "UP"
+		if atomic.LoadInt32(&slave.suspect) == 1 {
+			state = "SUSPECT"
+		}
+		slaves = append(slaves, slaveHealth{slave.id, state, slave.conn.RemoteAddr().String(), slave.silence()})
+	}
+	kvs.slaveMutex.Unlock()
+	kvs.hintMutex.Lock()
+	for id, since := range kvs.downSince {
+		slaves = append(slaves, slaveHealth{id, "DOWN", "-", time.Since(since)})
+	}
+	kvs.hintMutex.Unlock()
+
+	sort.Slice(slaves, func(i, j int) bool { return slaves[i].id < slaves[j].id })
+	reply := make([]string, 0, 4*len(slaves))
+	for _, s := range slaves {
+		reply = append(reply, s.id, s.state, s.addr, strconv.FormatInt(s.silence.Milliseconds(), 10))
+	}
+	return reply
+}
+
+func (kvs *KeyValueStore) removeSlave(slave *Slave) {
+	kvs.slaveMutex.Lock()
+	defer kvs.slaveMutex.Unlock()
+
+	for i, s := range kvs.slaves {
+		if s == slave {
+			kvs.slaves = append(kvs.slaves[:i], kvs.slaves[i+1:]...)
+			break
+		}
+	}
+	// Closing the connection makes the slave reconnect, which is when any
+	// transaction it still holds prepared gets resolved and missed requests
+	// are replayed.
+	slave.conn.Close()
+
+	// Unless it has already reconnected, its keys move on to the next
+	// slaves along the ring and requests it misses are kept for it
+	if kvs.slaveByID(slave.id) != nil {
+		return
+	}
+	if kvs.ring.Remove(slave.id) {
+		kvs.ringChanged()
+	}
+	kvs.hintMutex.Lock()
+	if _, down := kvs.downSince[slave.id]; !down && slave.id != "" {
+		kvs.downSince[slave.id] = time.Now()
+	}
+	kvs.hintMutex.Unlock()
+}
+
+// leadershipChanged follows the election. When we stop leading, the slaves
+// are let go so they reconnect to the new leader, and the followers' log
+// streams are closed.
+func (kvs *KeyValueStore) leadershipChanged(state election.State) {
+	switch {
+	case state.Role == election.Leader:
+		fmt.Printf(Green+"Elected leader for term %d\n"+Reset, state.Term)
+	case state.Role == election.Candidate:
+		fmt.Printf(Yellow+"Standing for leader in term %d\n"+Reset, state.Term)
+	case state.Leader != "":
+		fmt.Printf(Cyan+"Following %s, leader for term %d\n"+Reset, state.Leader, state.Term)
+	default:
+		fmt.Printf(Yellow+"No leader known in term %d\n"+Reset, state.Term)
+	}
+	if state.Role == election.Leader {
+		return
+	}
+
+	kvs.dropFollowers()
+	kvs.slaveMutex.Lock()
+	slaves := slices.Clone(kvs.slaves)
+	kvs.slaveMutex.Unlock()
+	for _, slave := range slaves {
+		slave.conn.Close()
+	}
+}
+
+// redirect tells a client or slave that connected while we don't lead
+// where the leader is, and closes the connection. It reports whether it
+// did.
+func (kvs *KeyValueStore) redirect(conn net.Conn) bool {
+	state := kvs.election.State()
+	if state.Role == election.Leader {
+		return false
+	}
+	fmt.Printf(Yellow+"Not the leader; redirecting %s to %q\n"+Reset, conn.RemoteAddr(), state.Leader)
+	protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpRedirect, 0, state.Leader))
+	conn.Close()
+	return true
+}
+
+func handleClient(conn net.Conn, kvs *KeyValueStore) {
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			break
+		}
+
+		// Only the leader serves clients; after losing an election we send
+		// them on to the new one
+		if state := kvs.election.State(); state.Role != election.Leader {
+			protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpRedirect, frame.ReqID, state.Leader))
+			conn.Close()
+			return
+		}
+		// A leader that hasn't heard from a majority lately may already
+		// have been replaced without knowing it
+		if !kvs.election.HoldsLease() {
+			protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpError, frame.ReqID, "leadership not confirmed by a majority of masters; try again"))
+			continue
+		}
+		if frame.Op == protocol.OpPing {
+			protocol.WriteFrame(conn, protocol.Frame{Op: protocol.OpPong, ReqID: frame.ReqID})
+			continue
+		}
+		args, err := frame.Args()
+		if err != nil {
+			protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error()))
+			continue
+		}
+		fmt.Printf(Yellow+"Received from Client: %s %q\n\n"+Reset, frame.Op, args)
+
+		var response protocol.Frame
+		switch {
+		case frame.Op == protocol.OpWrite && len(args) >= 2 && len(args) <= 4:
+			expiresAt, err := optionalExpiry(args, 2)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			level, err := optionalLevel(args, 3, writeLevel)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			version, acked, err := kvs.handleWrite(args[0], args[1], expiresAt, level)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			response = protocol.NewFrame(protocol.OpOK, frame.ReqID, "WRITE_DONE", strconv.FormatUint(version, 10), strconv.Itoa(acked))
+		case frame.Op == protocol.OpCAS && (len(args) == 3 || len(args) == 4),
+			frame.Op == protocol.OpSetNX && (len(args) == 2 || len(args) == 3):
+			// SETNX is a CAS that expects the key to be absent
+			if frame.Op == protocol.OpSetNX {
+				args = append([]string{args[0], "0"}, args[1:]...)
+			}
+			expected, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, fmt.Sprintf("invalid version %q", args[1]))
+				break
+			}
+			expiresAt, err := optionalExpiry(args, 3)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			version, ok, err := kvs.handleCAS(args[0], expected, args[2], expiresAt)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+			} else if ok {
+				response = protocol.NewFrame(protocol.OpOK, frame.ReqID, frame.Op.String()+"_DONE", strconv.FormatUint(version, 10))
+			} else {
+				response = protocol.NewFrame(protocol.OpConflict, frame.ReqID, args[0], strconv.FormatUint(version, 10))
+			}
+		case (frame.Op == protocol.OpIncrBy || frame.Op == protocol.OpDecrBy) && len(args) == 2:
+			delta, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil || (frame.Op == protocol.OpDecrBy && delta == math.MinInt64) {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, fmt.Sprintf("invalid increment %q", args[1]))
+				break
+			}
+			if frame.Op == protocol.OpDecrBy {
+				delta = -delta
+			}
+			result, err := kvs.handleUpdate(args[0], incrementBy(delta))
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			response = protocol.NewFrame(protocol.OpValue, frame.ReqID, args[0], result.Value, strconv.FormatUint(result.Version, 10))
+		case frame.Op == protocol.OpAppend && len(args) == 2:
+			suffix := args[1]
+			result, err := kvs.handleUpdate(args[0], func(current string, _ bool) (string, error) {
+				return current + suffix, nil
+			})
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			response = protocol.NewFrame(protocol.OpOK, frame.ReqID, "APPEND_DONE", strconv.FormatUint(result.Version, 10), strconv.Itoa(len(result.Value)))
+		case frame.Op == protocol.OpExpire && len(args) == 2, frame.Op == protocol.OpPersist && len(args) == 1:
+			var expiresAt int64
+			if frame.Op == protocol.OpExpire {
+				if expiresAt, err = ttlToExpiry(args[1]); err != nil {
+					response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+					break
+				}
+			}
+			existed, err := kvs.handleExpire(args[0], expiresAt)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+			} else if existed {
+				response = protocol.NewFrame(protocol.OpOK, frame.ReqID, frame.Op.String()+"_DONE")
+			} else {
+				response = protocol.NewFrame(protocol.OpNotFound, frame.ReqID, args[0])
+			}
+		case frame.Op == protocol.OpDelete && (len(args) == 1 || len(args) == 2):
+			level, err := optionalLevel(args, 1, writeLevel)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			existed, acked, err := kvs.handleDelete(args[0], level)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+			} else if existed {
+				response = protocol.NewFrame(protocol.OpOK, frame.ReqID, "DELETED", strconv.Itoa(acked))
+			} else {
+				response = protocol.NewFrame(protocol.OpNotFound, frame.ReqID, args[0])
+			}
+		case frame.Op == protocol.OpMGet && len(args) > 0:
+			reply := make([]string, 0, 4*len(args))
+			for i, result := range kvs.handleMGet(args) {
+				found := "0"
+				if result.found {
+					found = "1"
+				}
+				reply = append(reply, args[i], found, result.value, strconv.FormatUint(result.version, 10))
+			}
+			response = protocol.NewFrame(protocol.OpValues, frame.ReqID, reply...)
+		case frame.Op == protocol.OpMSet && len(args) > 1 && len(args)%2 == 1:
+			level, err := optionalLevel(args, 0, writeLevel)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			versions, err := kvs.handleMSet(args[1:], level)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			reply := make([]string, 0, len(args)-1)
+			for i := 1; i < len(args); i += 2 {
+				reply = append(reply, args[i], strconv.FormatUint(versions[args[i]], 10))
+			}
+			response = protocol.NewFrame(protocol.OpOK, frame.ReqID, reply...)
+		case frame.Op == protocol.OpExec:
+			ops, err := kvs.handleExec(args)
+			if conflict, ok := err.(txnConflict); ok {
+				response = protocol.NewFrame(protocol.OpConflict, frame.ReqID, conflict.key, strconv.FormatUint(conflict.version, 10))
+				break
+			}
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			reply := []string{"EXEC_DONE"}
+			for _, op := range ops {
+				reply = append(reply, op.Key, strconv.FormatUint(op.Version, 10))
+			}
+			response = protocol.NewFrame(protocol.OpOK, frame.ReqID, reply...)
+		case frame.Op == protocol.OpScan && len(args) == 4:
+			limit := defaultScanCount
+			if args[3] != "" {
+				limit, err = strconv.Atoi(args[3])
+				if err != nil || limit <= 0 || limit > maxScanCount {
+					response = protocol.NewFrame(protocol.OpError, frame.ReqID, fmt.Sprintf("count must be between 1 and %d", maxScanCount))
+					break
+				}
+			}
+			page, cursor := kvs.handleScan(args[0], args[1], args[2], limit)
+			reply := []string{cursor}
+			for _, entry := range page {
+				reply = append(reply, entry.Key, entry.Value, strconv.FormatUint(entry.Version, 10))
+			}
+			response = protocol.NewFrame(protocol.OpPage, frame.ReqID, reply...)
+		case frame.Op == protocol.OpStats && len(args) == 0:
+			response = protocol.NewFrame(protocol.OpOK, frame.ReqID, kvs.stats()...)
+		case frame.Op == protocol.OpHealth && len(args) == 0:
+			response = protocol.NewFrame(protocol.OpOK, frame.ReqID, kvs.health()...)
+		case frame.Op == protocol.OpRead && (len(args) == 1 || len(args) == 2):
+			level, err := optionalLevel(args, 1, readLevel)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+				break
+			}
+			result, err := kvs.handleRead(args[0], level)
+			if err != nil {
+				response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+			} else if result.found {
+				response = protocol.NewFrame(protocol.OpValue, frame.ReqID, args[0], result.value, strconv.FormatUint(result.version, 10), strconv.Itoa(result.replicas))
+			} else {
+				response = protocol.NewFrame(protocol.OpNotFound, frame.ReqID, args[0])
+			}
+		default:
+			response = protocol.NewFrame(protocol.OpError, frame.ReqID, "INVALID_COMMAND")
+		}
+		// The lease may have lapsed while the request ran, in which case a
+		// new leader may already hold a different answer
+		if response.Op != protocol.OpError && !kvs.election.HoldsLease() {
+			response = protocol.NewFrame(protocol.OpError, frame.ReqID, "leadership lost while the request ran; try again")
+		}
+		protocol.WriteFrame(conn, response)
+	}
+}
+
+func handleConnection(conn net.Conn, kvs *KeyValueStore) {
+	frame, err := protocol.ReadFrame(conn)
+	if err != nil {
+		fmt.Printf(Red+"Read error: %v%s\n", err, Reset)
+		return
+	}
+	args, err := frame.Args()
+	if frame.Op != protocol.OpHello || err != nil || len(args) == 0 {
+		fmt.Printf(Red+"Expected HELLO, got %s%s\n", frame.Op, Reset)
+		conn.Close()
+		return
+	}
+	var data string = args[0]
+	fmt.Println(Yellow+"Received:", data+Reset)
+
+	if data == "CLIENT" {
+		fmt.Println(Green+"Client Connected"+Reset)
+		if kvs.redirect(conn) {
+			return
+		}
+		protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpOK, 0))
+		go handleClient(conn, kvs)
+	} else if data == "SLAVE" {
+		if kvs.redirect(conn) {
+			return
+		}
+		fmt.Println(Green+"Slave Connected"+Reset)
+		remoteAddr := conn.RemoteAddr()
+		var ip string
+		var port int
+
+		switch addr := remoteAddr.(type) {
+		case *net.TCPAddr:
+			ip = addr.IP.String()
+			port = addr.Port
+		case *net.UDPAddr:
+			ip = addr.IP.String()
+			port = addr.Port
+		default:
+			fmt.Println("Error")
+		}
+		var id string
+		var txnIDs []string
+		if len(args) > 1 {
+			id, txnIDs = args[1], args[2:]
+		}
+		if id == "" {
+			// Without a node ID the slave can only be placed by address
+			id = fmt.Sprintf("%s:%d", ip, port)
+		}
+		fmt.Printf("Connection of slave %s: %s %d\n", id, ip, port)
+		// Replies and keepalives from the slave are read by the slave's
+		// own dispatcher goroutine, started by newSlave.
+		slave := newSlave(id, conn)
+		kvs.hintMutex.Lock()
+		downSince, rejoined := kvs.downSince[id]
+		kvs.hintMutex.Unlock()
+		if rejoined {
+			fmt.Printf(Green+"Slave %s rejoined after %v and takes back its place on the ring\n"+Reset, id, time.Since(downSince).Round(time.Second))
+			// Writes made while it was off the ring went to other slaves
+			// and only some were hinted; reads try it last until the
+			// rebalance its return sets off has caught it up
+			atomic.StoreInt32(&slave.stale, 1)
+		}
+		kvs.resolvePendingTxns(slave, txnIDs)
+		// The slave only takes new requests once it has caught up on the
+		// ones it missed.
+		if err := kvs.replayHints(slave); err != nil {
+			fmt.Printf(Red+"Replaying hints to slave %s failed: %v\n"+Reset, id, err)
+			conn.Close()
+			return
+		}
+		kvs.slaveMutex.Lock()
+		// We may have lost the election since the slave said HELLO
+		if !kvs.election.Leading() {
+			kvs.slaveMutex.Unlock()
+			conn.Close()
+			return
+		}
+		// A slave that reconnects before its old connection is seen to drop
+		// replaces it, keeping its place on the ring
+		if old := kvs.slaveByID(id); old != nil {
+			fmt.Printf(Yellow+"Slave %s reconnected; closing its old connection\n"+Reset, id)
+			kvs.slaves = slices.DeleteFunc(kvs.slaves, func(s *Slave) bool { return s == old })
+			old.conn.Close()
+		}
+		kvs.slaves = append(kvs.slaves, slave)
+		joined := kvs.ring.Add(id)
+		kvs.slaveMutex.Unlock()
+		if joined {
+			kvs.ringChanged()
+		}
+
+		// A slave whose connection drops stops being a replica right away,
+		// rather than at the next request that fails on it.
+		go func() {
+			<-slave.closed
+			kvs.removeSlave(slave)
+		}()
+	} else if data == "PEER" {
+		kvs.election.Serve(conn)
+	} else if data == "MASTER" && len(args) == 2 {
+		term, _ := strconv.ParseUint(args[1], 10, 64)
+		kvs.followLeader(conn, term)
+	}
+}
+
+// Run serves on port, keeping the log and election state in dataDir ("" for
+// the working directory) and answering from cache, if not nil. It only
+// returns if the settings are invalid or the port cannot be listened on.
+func Run(port, dataDir string, cache Cache) error {
+	readLevel, writeLevel = strings.ToUpper(readLevel), strings.ToUpper(writeLevel)
+	for _, level := range []string{readLevel, writeLevel} {
+		if _, err := requiredReplicas(level, 1); err != nil {
+			return err
+		}
+	}
+
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	fmt.Printf("Server is listening on port %s...\n", port)
+
+	kvs := NewKeyValueStore(dataDir, cache)
+	defer kvs.closeResources()
+
+	// Pick up where the log left off; a leader streams us the rest
+	kvs.loadLog()
+
+	// Take part in electing the leader, which alone serves clients and
+	// slaves and streams its log to the others
+	if self == "" {
+		self = "localhost:" + port
+	}
+	var peers []string
+	for _, addr := range strings.Split(peerList, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" && addr != self {
+			peers = append(peers, addr)
+		}
+	}
+	kvs.election, err = election.New(election.Config{
+		Self:      self,
+		Peers:     peers,
+		StateFile: filepath.Join(dataDir, "election.state"),
+		LastLog:   kvs.lastLog,
+		OnChange:  kvs.leadershipChanged,
+	})
+	if err != nil {
+		return err
+	}
+	kvs.election.Start()
+	for _, addr := range peers {
+		go kvs.replicateTo(addr)
+	}
+
+	// Everything below asks the election whether we lead, so it only
+	// starts once there is one
+	if syncInterval > 0 {
+		go kvs.antiEntropy(syncInterval)
+	}
+	if rebalanceRate > 0 {
+		go kvs.rebalancer()
+	}
+	if heartbeatInterval > 0 {
+		go kvs.detectFailures()
+	}
+
+	for {
+		conn, err := ln.Accept() // Accept a connection
+		if err != nil {
+			fmt.Println("Error accepting connection:", err)
+			continue
+		}
+		go handleConnection(conn, kvs) // Handle each client concurrently
+	}
+}
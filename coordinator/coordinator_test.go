@@ -0,0 +1,528 @@
+package coordinator
+
+import (
+	"math"
+	"net"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kvstore/election"
+	"kvstore/oplog"
+	"kvstore/protocol"
+)
+
+// fakeSlave answers a master's reads, writes and scans from memory.
+type fakeSlave struct {
+	id     string
+	mu     sync.Mutex
+	data   map[string]oplog.Entry // by key; Op is DELETE for tombstones
+	refuse bool                   // answer every write with an error
+}
+
+func newFakeSlave(id string, entries ...oplog.Entry) *fakeSlave {
+	s := &fakeSlave{id: id, data: make(map[string]oplog.Entry)}
+	for _, entry := range entries {
+		s.data[entry.Key] = entry
+	}
+	return s
+}
+
+// live returns a live entry for key, as a slave stores it.
+func live(key, value string, version uint64) oplog.Entry {
+	return oplog.Entry{Op: "WRITE", Key: key, Value: value, Version: version}
+}
+
+// tombstone returns a deleted entry for key.
+func tombstone(key string, version uint64) oplog.Entry {
+	return oplog.Entry{Op: "DELETE", Key: key, Version: version}
+}
+
+// get returns what s holds for key.
+func (s *fakeSlave) get(key string) (oplog.Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.data[key]
+	return entry, ok
+}
+
+// serve answers the master on conn until it is closed.
+func (s *fakeSlave) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		args, _ := frame.Args()
+		if err := protocol.WriteFrame(conn, s.answer(frame, args)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeSlave) answer(frame protocol.Frame, args []string) protocol.Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case frame.Op == protocol.OpRead && len(args) == 1:
+		entry, ok := s.data[args[0]]
+		version := strconv.FormatUint(entry.Version, 10)
+		if ok && entry.Op != "DELETE" {
+			return protocol.NewFrame(protocol.OpValue, frame.ReqID, entry.Key, entry.Value, version, strconv.FormatInt(entry.ExpiresAt, 10))
+		}
+		return protocol.NewFrame(protocol.OpNotFound, frame.ReqID, args[0], version)
+
+	case frame.Op == protocol.OpWrite && len(args) == 4 && !s.refuse:
+		expiresAt, _ := strconv.ParseInt(args[2], 10, 64)
+		version, _ := strconv.ParseUint(args[3], 10, 64)
+		s.data[args[0]] = oplog.Entry{Op: "WRITE", Key: args[0], Value: args[1], ExpiresAt: expiresAt, Version: version}
+		return protocol.NewFrame(protocol.OpOK, frame.ReqID, args[0])
+
+	case frame.Op == protocol.OpScan && len(args) == 4:
+		start, end, prefix := args[0], args[1], args[2]
+		limit, _ := strconv.Atoi(args[3])
+		var keys []string
+		for key := range s.data {
+			if key >= start && (end == "" || key < end) && strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		if len(keys) > limit {
+			keys = keys[:limit]
+		}
+		var values []string
+		for _, key := range keys {
+			entry := s.data[key]
+			found := "1"
+			if entry.Op == "DELETE" {
+				found = "0"
+			}
+			values = append(values, key, found, entry.Value, strconv.FormatUint(entry.Version, 10))
+		}
+		return protocol.NewFrame(protocol.OpValues, frame.ReqID, values...)
+	}
+	return protocol.NewFrame(protocol.OpError, frame.ReqID, "refused "+string(frame.Op))
+}
+
+// newTestStore returns a store with no cache whose slaves are the given
+// fakes, all on the ring.
+func newTestStore(t *testing.T, slaves ...*fakeSlave) *KeyValueStore {
+	t.Helper()
+	kvs := NewKeyValueStore(t.TempDir(), nil)
+	t.Cleanup(kvs.closeResources)
+	for _, fake := range slaves {
+		master, conn := net.Pipe()
+		go fake.serve(conn)
+		t.Cleanup(func() { master.Close() })
+		kvs.slaves = append(kvs.slaves, newSlave(fake.id, master))
+		kvs.ring.Add(fake.id)
+	}
+	return kvs
+}
+
+func TestTTLToExpiry(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  string
+		want time.Duration // from now, 0 for an error
+	}{
+		{"one second", "1", time.Second},
+		{"one day", "86400", 24 * time.Hour},
+		{"zero", "0", 0},
+		{"negative", "-5", 0},
+		{"not a number", "soon", 0},
+		{"fractional", "1.5", 0},
+		{"empty", "", 0},
+		{"too large", "99999999999999999999", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now()
+			got, err := ttlToExpiry(tt.ttl)
+			after := time.Now()
+			if tt.want == 0 {
+				if err == nil {
+					t.Fatalf("ttlToExpiry(%q) = %d, want an error", tt.ttl, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ttlToExpiry(%q): %v", tt.ttl, err)
+			}
+			if got < before.Add(tt.want).UnixMilli() || got > after.Add(tt.want).UnixMilli() {
+				t.Errorf("ttlToExpiry(%q) = %d, want %v from now", tt.ttl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncrementBy(t *testing.T) {
+	maxInt, minInt := strconv.FormatInt(math.MaxInt64, 10), strconv.FormatInt(math.MinInt64, 10)
+	tests := []struct {
+		name    string
+		current string
+		exists  bool
+		delta   int64
+		want    string
+		wantErr string
+	}{
+		{"missing key counts as 0", "", false, 5, "5", ""},
+		{"increment", "10", true, 3, "13", ""},
+		{"decrement below zero", "2", true, -5, "-3", ""},
+		{"up to the largest integer", strconv.FormatInt(math.MaxInt64-1, 10), true, 1, maxInt, ""},
+		{"down to the smallest integer", strconv.FormatInt(math.MinInt64+1, 10), true, -1, minInt, ""},
+		{"past the largest integer", maxInt, true, 1, "", "increment would overflow"},
+		{"past the smallest integer", minInt, true, -1, "", "increment would overflow"},
+		{"largest delta from a missing key", "", false, math.MaxInt64, maxInt, ""},
+		{"largest delta from 1", "1", true, math.MaxInt64, "", "increment would overflow"},
+		{"smallest delta from -1", "-1", true, math.MinInt64, "", "increment would overflow"},
+		{"not an integer", "ten", true, 1, "", "value is not an integer"},
+		{"empty value", "", true, 1, "", "value is not an integer"},
+		{"beyond int64", "9223372036854775808", true, -1, "", "value is not an integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := incrementBy(tt.delta)(tt.current, tt.exists)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("incrementing %q by %d = %q, %v, want error %q", tt.current, tt.delta, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("incrementing %q by %d = %q, %v, want %q", tt.current, tt.delta, got, err, tt.want)
+			}
+		})
+	}
+}
+
+// lead has kvs elect itself leader of a cluster of its own, so that its
+// changes are logged, and waits until it holds the lease.
+func lead(t *testing.T, kvs *KeyValueStore) {
+	t.Helper()
+	node, err := election.New(election.Config{
+		Self:      "self",
+		StateFile: filepath.Join(t.TempDir(), "election.state"),
+		LastLog:   kvs.lastLog,
+	})
+	if err != nil {
+		t.Fatalf("election.New: %v", err)
+	}
+	kvs.election = node
+	node.Start()
+
+	deadline := time.Now().Add(2 * election.MaxElectionTimeout)
+	for !node.HoldsLease() {
+		if time.Now().After(deadline) {
+			t.Fatalf("no lease after %v; state %+v", 2*election.MaxElectionTimeout, node.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// keysOf returns the keys and values of page as "key=value".
+func keysOf(page []oplog.Entry) []string {
+	pairs := make([]string, len(page))
+	for i, entry := range page {
+		pairs[i] = entry.Key + "=" + entry.Value
+	}
+	return pairs
+}
+
+func TestScanMerge(t *testing.T) {
+	tests := []struct {
+		name               string
+		slaves             [][]oplog.Entry
+		start, end, prefix string
+		limit              int
+		want               []string
+		wantCursor         string
+	}{
+		{
+			name:   "newest copy wins",
+			slaves: [][]oplog.Entry{{live("a", "old", 1)}, {live("a", "new", 2)}, {live("a", "old", 1)}},
+			limit:  10,
+			want:   []string{"a=new"},
+		},
+		{
+			name:   "newer tombstone hides the key",
+			slaves: [][]oplog.Entry{{live("a", "1", 1), live("b", "1", 1)}, {tombstone("a", 2)}},
+			limit:  10,
+			want:   []string{"b=1"},
+		},
+		{
+			name:   "older tombstone doesn't",
+			slaves: [][]oplog.Entry{{live("a", "2", 2)}, {tombstone("a", 1)}},
+			limit:  10,
+			want:   []string{"a=2"},
+		},
+		{
+			name:   "prefix",
+			slaves: [][]oplog.Entry{{live("user:1", "x", 1), live("video:1", "x", 1)}, {live("user:2", "y", 1)}},
+			prefix: "user:",
+			limit:  10,
+			want:   []string{"user:1=x", "user:2=y"},
+		},
+		{
+			name:   "start and end",
+			slaves: [][]oplog.Entry{{live("a", "1", 1), live("c", "1", 1)}, {live("b", "1", 1), live("d", "1", 1)}},
+			start:  "b",
+			end:    "d",
+			limit:  10,
+			want:   []string{"b=1", "c=1"},
+		},
+		{
+			name:       "page stops at the smallest last key of a full slave page",
+			slaves:     [][]oplog.Entry{{live("a", "1", 1), live("b", "1", 1)}, {live("c", "1", 1)}},
+			limit:      2,
+			want:       []string{"a=1", "b=1"},
+			wantCursor: "b\x00",
+		},
+		{
+			name:       "tombstones count towards a slave's page",
+			slaves:     [][]oplog.Entry{{tombstone("a", 1), tombstone("b", 1)}, {live("c", "1", 1)}},
+			limit:      2,
+			want:       []string{},
+			wantCursor: "b\x00",
+		},
+		{
+			name:       "more keys than the limit",
+			slaves:     [][]oplog.Entry{{live("a", "1", 1), live("c", "1", 1)}, {live("b", "1", 1), live("d", "1", 1)}},
+			limit:      2,
+			want:       []string{"a=1", "b=1"},
+			wantCursor: "b\x00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var slaves []*fakeSlave
+			for i, entries := range tt.slaves {
+				slaves = append(slaves, newFakeSlave("slave"+strconv.Itoa(i), entries...))
+			}
+			kvs := newTestStore(t, slaves...)
+
+			page, cursor := kvs.handleScan(tt.start, tt.end, tt.prefix, tt.limit)
+			if got := keysOf(page); !slices.Equal(got, tt.want) || cursor != tt.wantCursor {
+				t.Errorf("scan = %q, cursor %q, want %q, cursor %q", got, cursor, tt.want, tt.wantCursor)
+			}
+		})
+	}
+}
+
+func TestScanCursor(t *testing.T) {
+	// Each slave holds every third key, some of them deleted since
+	var slaves [3][]oplog.Entry
+	var want []string
+	for i := 0; i < 20; i++ {
+		key := "k" + strconv.Itoa(100+i)
+		if i%4 == 3 {
+			slaves[i%3] = append(slaves[i%3], tombstone(key, 1))
+			continue
+		}
+		slaves[i%3] = append(slaves[i%3], live(key, "v", 1))
+		want = append(want, key+"=v")
+	}
+	kvs := newTestStore(t, newFakeSlave("s0", slaves[0]...), newFakeSlave("s1", slaves[1]...), newFakeSlave("s2", slaves[2]...))
+
+	for _, limit := range []int{1, 2, 3, 5, 50} {
+		var got []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 40 {
+				t.Fatalf("limit %d: scan did not finish after %d pages", limit, pages)
+			}
+			page, next := kvs.handleScan(cursor, "", "", limit)
+			if len(page) > limit {
+				t.Fatalf("limit %d: page of %d keys", limit, len(page))
+			}
+			got = append(got, keysOf(page)...)
+			if next == "" {
+				break
+			}
+			if next <= cursor {
+				t.Fatalf("limit %d: cursor went from %q back to %q", limit, cursor, next)
+			}
+			cursor = next
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("limit %d: scanned %q, want %q", limit, got, want)
+		}
+	}
+}
+
+func TestRequiredReplicas(t *testing.T) {
+	defer func(n int) { replicationFactor = n }(replicationFactor)
+
+	tests := []struct {
+		name      string
+		factor    int // replicationFactor
+		level     string
+		connected int
+		want      int // 0 for an error
+	}{
+		{"ONE", 3, "ONE", 5, 1},
+		{"QUORUM of 3", 3, "QUORUM", 5, 2},
+		{"QUORUM of 4", 4, "QUORUM", 5, 3},
+		{"ALL", 3, "ALL", 5, 3},
+		{"ALL counts replicas, not connected slaves", 3, "ALL", 1, 3},
+		{"count", 3, "2", 5, 2},
+		{"count above N", 3, "5", 5, 5},
+		{"majority of connected slaves, QUORUM", 0, "QUORUM", 5, 3},
+		{"majority of connected slaves, ALL", 0, "ALL", 4, 4},
+		{"no slaves, ALL", 0, "ALL", 0, 1},
+		{"zero", 3, "0", 5, 0},
+		{"negative", 3, "-1", 5, 0},
+		{"unknown level", 3, "MOST", 5, 0},
+		{"lower case", 3, "quorum", 5, 0},
+		{"empty", 3, "", 5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replicationFactor = tt.factor
+			got, err := requiredReplicas(tt.level, tt.connected)
+			if tt.want == 0 {
+				if err == nil {
+					t.Fatalf("requiredReplicas(%q, %d) = %d, want an error", tt.level, tt.connected, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("requiredReplicas(%q, %d) with N=%d = %d, %v, want %d", tt.level, tt.connected, tt.factor, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptionalLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		i       int
+		want    string
+		wantErr bool
+	}{
+		{"absent", []string{"key"}, 1, "QUORUM", false},
+		{"empty", []string{"key", ""}, 1, "QUORUM", false},
+		{"given", []string{"key", "ALL"}, 1, "ALL", false},
+		{"lower case", []string{"key", "one"}, 1, "ONE", false},
+		{"count", []string{"key", "2"}, 1, "2", false},
+		{"first argument", []string{"all", "a", "1"}, 0, "ALL", false},
+		{"invalid", []string{"key", "MOST"}, 1, "", true},
+		{"zero", []string{"key", "0"}, 1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := optionalLevel(tt.args, tt.i, "QUORUM")
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("optionalLevel(%q, %d) = %q, %v, want %q", tt.args, tt.i, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCAS(t *testing.T) {
+	defer func(n int, w string) { replicationFactor, writeLevel = n, w }(replicationFactor, writeLevel)
+	replicationFactor, writeLevel = 3, "QUORUM"
+
+	// Every key is on all three slaves, which don't all hold its newest copy
+	slaves := []*fakeSlave{
+		newFakeSlave("s0", live("set", "a", 5), live("lagging", "a", 5), live("deleted", "a", 3), live("gone", "a", 3)),
+		newFakeSlave("s1", live("set", "a", 5), live("lagging", "b", 9), tombstone("deleted", 7), tombstone("gone", 7)),
+		newFakeSlave("s2", live("set", "a", 5), live("lagging", "a", 5), live("deleted", "a", 3), live("gone", "a", 3)),
+	}
+	kvs := newTestStore(t, slaves...)
+	lead(t, kvs)
+
+	tests := []struct {
+		name        string
+		key         string
+		expected    uint64 // 0 for SETNX
+		wantOK      bool
+		wantVersion uint64 // when the write is refused
+	}{
+		{"SETNX on a missing key", "missing", 0, true, 0},
+		{"SETNX on a set key", "set", 0, false, 5},
+		{"SETNX on a deleted key", "deleted", 0, true, 0},
+		{"CAS on a missing key", "missing2", 3, false, 0},
+		{"CAS with a stale version", "set", 4, false, 5},
+		{"CAS with the version of a lagging replica", "lagging", 5, false, 9},
+		{"CAS with the newest version", "lagging", 9, true, 0},
+		{"CAS on a deleted key with its last live version", "gone", 3, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, ok, err := kvs.handleCAS(tt.key, tt.expected, "new", 0)
+			if err != nil {
+				t.Fatalf("CAS %q expecting %d: %v", tt.key, tt.expected, err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("CAS %q expecting %d = %d, %v, want %v", tt.key, tt.expected, version, ok, tt.wantOK)
+			}
+			if !ok {
+				if version != tt.wantVersion {
+					t.Errorf("refused CAS %q reported version %d, want %d", tt.key, version, tt.wantVersion)
+				}
+				return
+			}
+			if version <= tt.expected {
+				t.Errorf("CAS %q expecting %d wrote version %d", tt.key, tt.expected, version)
+			}
+			for _, slave := range slaves {
+				if entry, _ := slave.get(tt.key); entry.Value != "new" || entry.Version != version {
+					t.Errorf("slave %s holds %q at %d, want %q at %d", slave.id, entry.Value, entry.Version, "new", version)
+				}
+			}
+
+			// The same expectation fails now that the key has moved on
+			if current, ok, _ := kvs.handleCAS(tt.key, tt.expected, "again", 0); ok || current != version {
+				t.Errorf("repeated CAS %q expecting %d = %d, %v, want %d, false", tt.key, tt.expected, current, ok, version)
+			}
+		})
+	}
+}
+
+func TestWriteFailsWithoutRequiredAcks(t *testing.T) {
+	defer func(n int) { replicationFactor = n }(replicationFactor)
+	replicationFactor = 3
+
+	slaves := []*fakeSlave{newFakeSlave("s0"), newFakeSlave("s1"), newFakeSlave("s2")}
+	slaves[1].refuse = true
+	slaves[2].refuse = true
+	kvs := newTestStore(t, slaves...)
+	lead(t, kvs)
+
+	// Only s0 takes the write, which is short of a quorum of 3
+	acked, err := kvs.applyWrite("key", "1", 0, kvs.nextVersion("key"), "QUORUM")
+	if acked != 1 || err == nil || !strings.Contains(err.Error(), "acknowledged") {
+		t.Fatalf("QUORUM write = %d acks, %v; want 1 ack and an error", acked, err)
+	}
+	if entry, _ := slaves[0].get("key"); entry.Value != "1" {
+		t.Fatalf("s0 holds %q after the write, want %q", entry.Value, "1")
+	}
+
+	// The slaves that refused were dropped, so the next QUORUM write is
+	// refused before it is sent; the level still counts N replicas
+	acked, err = kvs.applyWrite("key", "2", 0, kvs.nextVersion("key"), "QUORUM")
+	if acked != 0 || err == nil || !strings.Contains(err.Error(), "connected") {
+		t.Fatalf("QUORUM write with one replica left = %d acks, %v; want 0 acks and an error", acked, err)
+	}
+	if entry, _ := slaves[0].get("key"); entry.Value != "1" {
+		t.Fatalf("s0 holds %q after a refused write, want %q", entry.Value, "1")
+	}
+
+	acked, err = kvs.applyWrite("key", "3", 0, kvs.nextVersion("key"), "ONE")
+	if acked != 1 || err != nil {
+		t.Fatalf("ONE write with one replica left = %d acks, %v; want 1 ack", acked, err)
+	}
+	if entry, _ := slaves[0].get("key"); entry.Value != "3" {
+		t.Fatalf("s0 holds %q after the write, want %q", entry.Value, "3")
+	}
+}
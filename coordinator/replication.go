@@ -0,0 +1,465 @@
+package coordinator
+
+// The leader's log is replicated to the other masters over TCP, so they can
+// run on other hosts. For every peer the leader keeps a connection open: it
+// says HELLO MASTER with its term, the follower answers with how many log
+// entries it holds and a hash of the last one, and the leader streams it
+// the rest as LOG frames, numbered by their line in the log, then every new
+// entry as it is logged. The follower acknowledges each entry once it has
+// it on disk. A follower that led in an earlier term may hold entries the
+// leader never saw; its log is then replaced with the leader's, so the
+// masters never keep two histories.
+//
+// Replication doesn't hold up client requests, with one exception: a
+// committed transaction waits briefly for the followers to acknowledge it,
+// so a follower taking over knows to commit it on slaves that hold it
+// prepared.
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"kvstore/election"
+	"kvstore/oplog"
+	"kvstore/protocol"
+)
+
+const (
+	replicationRetry   = 2 * time.Second // wait between attempts to reach a follower
+	replicationTimeout = 5 * time.Second // for the handshake and each entry sent
+)
+
+// logPath is where the log is kept.
+func (kvs *KeyValueStore) logPath() string { return filepath.Join(kvs.dataDir, "kv_store.log") }
+
+// logHash identifies a log entry, so leader and follower can tell whether
+// their logs agree up to it.
+func logHash(line string) string {
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// backupLink is an open replication connection to a follower.
+type backupLink struct {
+	addr  string
+	conn  net.Conn
+	acked uint64        // log entries the follower has confirmed, guarded by backupMutex
+	grew  chan struct{} // signalled when the log gains entries
+}
+
+// replicateTo keeps the master at addr supplied with the log whenever we
+// lead, reconnecting whenever the connection is lost.
+func (kvs *KeyValueStore) replicateTo(addr string) {
+	quiet := false
+	for {
+		if !kvs.election.Leading() {
+			time.Sleep(election.HeartbeatInterval)
+			continue
+		}
+		connected, err := kvs.streamLog(addr)
+		// An unreachable follower is reported once, not on every retry
+		if connected || !quiet {
+			fmt.Printf(Yellow+"Replication to %s stopped: %v\n"+Reset, addr, err)
+		}
+		quiet = !connected
+		time.Sleep(replicationRetry)
+	}
+}
+
+// streamLog connects to the follower at addr and sends it the log entries
+// it lacks, then new ones as they come, until the connection fails or we
+// no longer lead. It reports whether the follower was reached.
+func (kvs *KeyValueStore) streamLog(addr string) (bool, error) {
+	term := kvs.election.State().Term
+	conn, err := net.DialTimeout("tcp", addr, replicationTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	if err := protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpHello, 0, "MASTER", strconv.FormatUint(term, 10))); err != nil {
+		return false, err
+	}
+	reply, err := protocol.ReadFrame(conn)
+	if err != nil {
+		return false, err
+	}
+	args, err := reply.Args()
+	if err == nil && reply.Op == protocol.OpError && len(args) == 1 {
+		return false, fmt.Errorf("follower refused the log: %s", args[0])
+	}
+	if err != nil || reply.Op != protocol.OpOK || len(args) != 2 {
+		return false, fmt.Errorf("unexpected answer to HELLO: %s", reply.Op)
+	}
+	held, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("bad log position from follower: %v", err)
+	}
+	tail := args[1]
+	conn.SetDeadline(time.Time{})
+
+	file, err := os.Open(kvs.logPath())
+	if err != nil {
+		return true, err
+	}
+	defer file.Close()
+
+	kvs.logMutex.Lock()
+	logged := kvs.logSeq
+	kvs.logMutex.Unlock()
+
+	link := &backupLink{addr: addr, conn: conn, grew: make(chan struct{}, 1)}
+	kvs.backupMutex.Lock()
+	kvs.backups = append(kvs.backups, link)
+	kvs.backupMutex.Unlock()
+	defer func() {
+		kvs.backupMutex.Lock()
+		kvs.backups = slices.DeleteFunc(kvs.backups, func(b *backupLink) bool { return b == link })
+		kvs.backupAcked.Broadcast()
+		kvs.backupMutex.Unlock()
+	}()
+	if !kvs.election.Leading() {
+		return true, fmt.Errorf("no longer leading")
+	}
+	fmt.Printf(Green+"%s connected for replication, holding %d of our %d log entries\n"+Reset, addr, held, logged)
+
+	acksDone := make(chan error, 1)
+	go func() { acksDone <- kvs.readAcks(link) }()
+
+	reader := bufio.NewReader(file)
+	var seq uint64
+	var partial string
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err == io.EOF {
+			if seq < held {
+				// The follower has entries beyond the end of our log
+				fmt.Printf(Yellow+"%s holds %d log entries but ours has only %d; sending ours from the start\n"+Reset, addr, held, logged)
+				held = 0
+				file.Seek(0, io.SeekStart)
+				reader.Reset(file)
+				seq, partial = 0, ""
+				continue
+			}
+			// Caught up; a line without its newline is still being written
+			select {
+			case <-link.grew:
+				continue
+			case err := <-acksDone:
+				return true, err
+			}
+		}
+		if err != nil {
+			return true, err
+		}
+		line, partial = strings.TrimSuffix(partial, "\n"), ""
+		seq++
+		if seq < held {
+			continue
+		}
+		if seq == held {
+			if logHash(line) != tail {
+				fmt.Printf(Yellow+"%s's log differs from ours at entry %d; sending ours from the start\n"+Reset, addr, seq)
+				held = 0
+				file.Seek(0, io.SeekStart)
+				reader.Reset(file)
+				seq = 0
+				continue
+			}
+			kvs.backupMutex.Lock()
+			link.acked = held
+			kvs.backupMutex.Unlock()
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		if err := protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpLog, 0, strconv.FormatUint(seq, 10), line)); err != nil {
+			return true, err
+		}
+	}
+}
+
+// readAcks records the follower's acknowledgements until the connection
+// fails or the follower rejects an entry.
+func (kvs *KeyValueStore) readAcks(link *backupLink) error {
+	defer link.conn.Close()
+	for {
+		frame, err := protocol.ReadFrame(link.conn)
+		if err != nil {
+			return err
+		}
+		args, err := frame.Args()
+		if err != nil || len(args) != 1 {
+			return fmt.Errorf("bad acknowledgement from follower")
+		}
+		if frame.Op != protocol.OpOK {
+			return fmt.Errorf("follower refused the log: %s", args[0])
+		}
+		seq, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad acknowledgement from follower: %v", err)
+		}
+
+		kvs.backupMutex.Lock()
+		link.acked = seq
+		kvs.backupAcked.Broadcast()
+		kvs.backupMutex.Unlock()
+	}
+}
+
+// logGrew wakes the replication of every connected follower.
+func (kvs *KeyValueStore) logGrew() {
+	kvs.backupMutex.Lock()
+	defer kvs.backupMutex.Unlock()
+	for _, link := range kvs.backups {
+		select {
+		case link.grew <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dropFollowers closes every replication connection, after we stop
+// leading.
+func (kvs *KeyValueStore) dropFollowers() {
+	kvs.backupMutex.Lock()
+	defer kvs.backupMutex.Unlock()
+	for _, link := range kvs.backups {
+		link.conn.Close()
+	}
+}
+
+// awaitBackups waits until every connected follower has acknowledged the
+// log up to entry seq, or timeout passes, and reports whether they all did.
+func (kvs *KeyValueStore) awaitBackups(seq uint64, timeout time.Duration) bool {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		kvs.backupMutex.Lock()
+		timedOut = true
+		kvs.backupAcked.Broadcast()
+		kvs.backupMutex.Unlock()
+	})
+	defer timer.Stop()
+
+	kvs.backupMutex.Lock()
+	defer kvs.backupMutex.Unlock()
+	for !timedOut {
+		if !slices.ContainsFunc(kvs.backups, func(link *backupLink) bool { return link.acked < seq }) {
+			return true
+		}
+		kvs.backupAcked.Wait()
+	}
+	return false
+}
+
+// replicationStats lists the election state, the log's length and how
+// much of it each connected follower has acknowledged, for STATS.
+func (kvs *KeyValueStore) replicationStats() []string {
+	state := kvs.election.State()
+	stats := []string{"election_term", strconv.FormatUint(state.Term, 10), "leader", state.Leader}
+
+	kvs.logMutex.Lock()
+	stats = append(stats, "log_entries", strconv.FormatUint(kvs.logSeq, 10))
+	kvs.logMutex.Unlock()
+
+	kvs.backupMutex.Lock()
+	defer kvs.backupMutex.Unlock()
+	for _, link := range kvs.backups {
+		stats = append(stats, "follower_"+link.addr+"_acked", strconv.FormatUint(link.acked, 10))
+	}
+	return stats
+}
+
+// loadLog replays the log we hold and counts its entries. A last line cut
+// short by a crash is dropped; it was never acknowledged, and a leader
+// sends it again.
+func (kvs *KeyValueStore) loadLog() {
+	file, err := os.Open(kvs.logPath())
+	if err != nil {
+		fmt.Printf(Yellow+"Could not open log file: %v\n"+Reset, err)
+		return
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var consumed int64
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf(Red+"Error reading log file: %v\n"+Reset, err)
+				break
+			}
+			if line != "" && kvs.logFile != nil {
+				fmt.Printf(Yellow+"Dropping a log entry cut short: %q\n"+Reset, line)
+				kvs.logFile.Truncate(consumed)
+			}
+			break
+		}
+		consumed += int64(len(line))
+		line = strings.TrimSuffix(line, "\n")
+		kvs.logSeq++
+		kvs.logTail = logHash(line)
+
+		entry, err := oplog.Parse(line)
+		if err != nil {
+			fmt.Printf(Red+"Skipping bad log entry: %v\n"+Reset, err)
+			continue
+		}
+		kvs.logTerm = entry.Term
+		kvs.applyLogEntry(entry)
+	}
+	fmt.Printf("Holding %d log entries\n", kvs.logSeq)
+}
+
+// followLeader receives the log of the leader of term on conn until the
+// connection fails or a newer stream takes its place.
+func (kvs *KeyValueStore) followLeader(conn net.Conn, term uint64) {
+	defer conn.Close()
+	if state := kvs.election.State(); state.Role == election.Leader || term < state.Term {
+		protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpError, 0, fmt.Sprintf("not following the leader of term %d", term)))
+		return
+	}
+
+	kvs.logMutex.Lock()
+	if kvs.leaderConn != nil {
+		kvs.leaderConn.Close()
+	}
+	kvs.leaderConn = conn
+	held, tail := kvs.logSeq, kvs.logTail
+	kvs.logMutex.Unlock()
+	defer func() {
+		kvs.logMutex.Lock()
+		if kvs.leaderConn == conn {
+			kvs.leaderConn = nil
+		}
+		kvs.logMutex.Unlock()
+	}()
+
+	fmt.Printf(Green+"Leader of term %d connected for replication; we hold %d log entries\n"+Reset, term, held)
+	if err := protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpOK, 0, strconv.FormatUint(held, 10), tail)); err != nil {
+		return
+	}
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			fmt.Printf(Yellow+"Replication stream from the leader closed: %v\n"+Reset, err)
+			return
+		}
+		args, err := frame.Args()
+		if err == nil && (frame.Op != protocol.OpLog || len(args) != 2) {
+			err = fmt.Errorf("expected LOG, got %s", frame.Op)
+		}
+		var seq uint64
+		if err == nil {
+			seq, err = strconv.ParseUint(args[0], 10, 64)
+		}
+		if err == nil {
+			err = kvs.appendReplica(conn, seq, args[1])
+		}
+		if err != nil {
+			fmt.Printf(Red+"Replication from the leader failed: %v\n"+Reset, err)
+			protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error()))
+			return
+		}
+		if err := protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpOK, frame.ReqID, args[0])); err != nil {
+			return
+		}
+	}
+}
+
+// appendReplica adds entry seq of the leader's log, received on conn, to
+// ours. Entries must arrive in order; a stream starting over at 1 replaces
+// the whole log, and with it everything we learnt from the old one.
+func (kvs *KeyValueStore) appendReplica(conn net.Conn, seq uint64, line string) error {
+	kvs.logMutex.Lock()
+	defer kvs.logMutex.Unlock()
+
+	if kvs.leaderConn != conn {
+		return fmt.Errorf("replaced by a newer stream")
+	}
+	if kvs.logFile == nil {
+		return fmt.Errorf("no log to write to")
+	}
+	if seq == 1 && kvs.logSeq > 0 {
+		fmt.Printf(Yellow+"Our log differs from the leader's; dropping our %d entries\n"+Reset, kvs.logSeq)
+		if err := kvs.logFile.Truncate(0); err != nil {
+			return err
+		}
+		kvs.logSeq, kvs.logTail, kvs.logTerm = 0, "", 0
+
+		// The cache, versions and committed transactions may hold changes
+		// the leader never had; the new log brings back the ones it did
+		kvs.forget()
+		kvs.versionMux.Lock()
+		kvs.versions = make(map[string]uint64)
+		kvs.versionMux.Unlock()
+		kvs.txnMutex.Lock()
+		kvs.committedTxns = make(map[string]bool)
+		kvs.txnMutex.Unlock()
+	}
+	if seq != kvs.logSeq+1 {
+		return fmt.Errorf("expected log entry %d, got %d", kvs.logSeq+1, seq)
+	}
+
+	if _, err := kvs.logFile.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	if err := kvs.logFile.Sync(); err != nil {
+		return err
+	}
+	kvs.logSeq, kvs.logTail = seq, logHash(line)
+
+	entry, err := oplog.Parse(line)
+	if err != nil {
+		fmt.Printf(Red+"Skipping bad log entry: %v\n"+Reset, err)
+		return nil
+	}
+	kvs.logTerm = entry.Term
+	kvs.applyLogEntry(entry)
+	fmt.Printf(Green+"Replicated %d: %s %q = %q\n"+Reset, seq, entry.Op, entry.Key, entry.Value)
+	return nil
+}
+
+// applyLogEntry notes what a logged or replicated entry tells us: which
+// transactions committed, and the versions handed out, should we come to
+// lead. The entry also goes to the cache, if there is one.
+func (kvs *KeyValueStore) applyLogEntry(entry oplog.Entry) {
+	if entry.Op == "TXN" {
+		ops, err := oplog.ParseTxn(entry.Value)
+		if err != nil {
+			fmt.Printf(Red+"Skipping bad transaction %s: %v\n"+Reset, entry.Key, err)
+			return
+		}
+		for _, op := range ops {
+			kvs.applyLogEntry(op)
+		}
+		kvs.txnMutex.Lock()
+		kvs.committedTxns[entry.Key] = true
+		kvs.txnMutex.Unlock()
+		return
+	}
+	kvs.remember(entry)
+	if entry.Version > 0 {
+		kvs.recordVersion(entry.Key, entry.Version)
+	}
+}
+
+// lastLog is the term of the last entry in the log and how many entries
+// the log holds, which the election compares between candidates.
+func (kvs *KeyValueStore) lastLog() (uint64, uint64) {
+	kvs.logMutex.Lock()
+	defer kvs.logMutex.Unlock()
+	return kvs.logTerm, kvs.logSeq
+}
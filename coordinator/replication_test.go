@@ -0,0 +1,240 @@
+package coordinator
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"kvstore/oplog"
+)
+
+// mapCache is a Cache with no limit that keeps the latest entry per key.
+type mapCache struct {
+	mu   sync.Mutex
+	data map[string]Cached
+}
+
+func (c *mapCache) Get(key string) (Cached, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.data[key]
+	return cached, ok
+}
+
+func (c *mapCache) Apply(entry oplog.Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch entry.Op {
+	case "WRITE":
+		c.data[entry.Key] = Cached{Value: entry.Value, ExpiresAt: entry.ExpiresAt, Version: entry.Version}
+	case "DELETE":
+		c.data[entry.Key] = Cached{Deleted: true, Version: entry.Version}
+	}
+}
+
+func (c *mapCache) Range(fn func(key string, cached Cached)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, cached := range c.data {
+		fn(key, cached)
+	}
+}
+
+func (c *mapCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = make(map[string]Cached)
+}
+
+// logLine returns the log line of a write of key to value at version in
+// term 1.
+func logLine(key, value string, version uint64) string {
+	return oplog.Format(oplog.Entry{Op: "WRITE", Key: key, Value: value, Version: version, Term: 1})
+}
+
+// follow returns a follower of a leader streaming to it on the returned
+// connection.
+func follow(t *testing.T) (*KeyValueStore, net.Conn) {
+	t.Helper()
+	kvs := newTestStore(t)
+	kvs.cache = &mapCache{data: make(map[string]Cached)}
+	conn, other := net.Pipe()
+	t.Cleanup(func() { conn.Close(); other.Close() })
+	kvs.leaderConn = conn
+	return kvs, conn
+}
+
+// logLines returns the lines in kvs's log file.
+func logLines(t *testing.T, kvs *KeyValueStore) []string {
+	t.Helper()
+	data, err := os.ReadFile(kvs.logPath())
+	if err != nil {
+		t.Fatalf("reading the log: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAppendReplicaOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		seqs    []uint64
+		wantErr int // index in seqs of the entry refused, -1 for none
+	}{
+		{"in order", []uint64{1, 2, 3}, -1},
+		{"gap", []uint64{1, 2, 4}, 2},
+		{"repeated", []uint64{1, 2, 2}, 2},
+		{"going back", []uint64{1, 2, 3, 2}, 3},
+		{"not starting at 1", []uint64{2}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kvs, conn := follow(t)
+			for i, seq := range tt.seqs {
+				err := kvs.appendReplica(conn, seq, logLine("k"+strconv.Itoa(i), "v", uint64(10+i)))
+				if (err != nil) != (i == tt.wantErr) {
+					t.Fatalf("appending entry %d as the %dth: %v", seq, i+1, err)
+				}
+				if err != nil {
+					break
+				}
+			}
+
+			held := len(tt.seqs)
+			if tt.wantErr >= 0 {
+				held = tt.wantErr
+			}
+			if kvs.logSeq != uint64(held) {
+				t.Errorf("holding %d entries, want %d", kvs.logSeq, held)
+			}
+			if held > 0 {
+				if lines := logLines(t, kvs); len(lines) != held {
+					t.Errorf("log file holds %d lines, want %d", len(lines), held)
+				}
+			}
+		})
+	}
+}
+
+func TestAppendReplicaFromReplacedStream(t *testing.T) {
+	kvs, conn := follow(t)
+	if err := kvs.appendReplica(conn, 1, logLine("a", "1", 10)); err != nil {
+		t.Fatalf("appending entry 1: %v", err)
+	}
+
+	// A newer leader's stream takes over
+	newer, other := net.Pipe()
+	defer newer.Close()
+	defer other.Close()
+	kvs.leaderConn = newer
+	if err := kvs.appendReplica(conn, 2, logLine("b", "1", 11)); err == nil {
+		t.Fatal("entry from a replaced stream accepted")
+	}
+	if kvs.logSeq != 1 {
+		t.Fatalf("holding %d entries, want 1", kvs.logSeq)
+	}
+}
+
+func TestAppendReplicaReplacesDivergentLog(t *testing.T) {
+	kvs, conn := follow(t)
+
+	// We led once and logged changes the new leader never saw
+	txn := oplog.Entry{Op: "TXN", Key: "txn-1", Value: oplog.FormatTxn([]oplog.Entry{{Op: "WRITE", Key: "t", Value: "1", Version: 20}}), Term: 1}
+	for i, line := range []string{logLine("ours", "1", 30), oplog.Format(txn), logLine("shared", "ours", 31)} {
+		if err := kvs.appendReplica(conn, uint64(i+1), line); err != nil {
+			t.Fatalf("appending our entry %d: %v", i+1, err)
+		}
+	}
+
+	// The leader's log starts over at 1
+	leader := []string{logLine("shared", "leader's", 25), logLine("theirs", "1", 26)}
+	for i, line := range leader {
+		if err := kvs.appendReplica(conn, uint64(i+1), line); err != nil {
+			t.Fatalf("appending the leader's entry %d: %v", i+1, err)
+		}
+	}
+
+	if lines := logLines(t, kvs); strings.Join(lines, "\n") != strings.Join(leader, "\n") {
+		t.Errorf("log holds %q, want the leader's %q", lines, leader)
+	}
+	if kvs.logSeq != 2 || kvs.logTail != logHash(leader[1]) {
+		t.Errorf("holding %d entries ending in %s, want 2 ending in %s", kvs.logSeq, kvs.logTail, logHash(leader[1]))
+	}
+
+	tests := []struct {
+		key       string
+		wantValue string // "" for unknown
+		version   uint64
+	}{
+		{"ours", "", 0},
+		{"t", "", 0},
+		{"shared", "leader's", 25},
+		{"theirs", "1", 26},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			cached, ok := kvs.cached(tt.key)
+			if ok != (tt.wantValue != "") || cached.Value != tt.wantValue {
+				t.Errorf("cache holds %q (%v), want %q", cached.Value, ok, tt.wantValue)
+			}
+			version, ok := kvs.versions[tt.key]
+			if ok != (tt.version != 0) || version != tt.version {
+				t.Errorf("version %d (%v), want %d", version, ok, tt.version)
+			}
+		})
+	}
+	if kvs.committedTxns["txn-1"] {
+		t.Error("a transaction only our old log held is still known as committed")
+	}
+}
+
+func TestLoadLogTornTail(t *testing.T) {
+	complete := []string{logLine("a", "1", 10), logLine("b", "1", 11)}
+	tests := []struct {
+		name string
+		log  string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"complete", strings.Join(complete, "\n") + "\n", complete},
+		{"torn last line", strings.Join(complete, "\n") + "\n" + logLine("c", "1", 12)[:10], complete},
+		{"only a torn line", logLine("c", "1", 12)[:10], nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kvs := newTestStore(t)
+			kvs.logFile.Close()
+			if err := os.WriteFile(kvs.logPath(), []byte(tt.log), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if kvs.logFile, err = os.OpenFile(kvs.logPath(), os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			kvs.loadLog()
+			if kvs.logSeq != uint64(len(tt.want)) {
+				t.Fatalf("holding %d entries, want %d", kvs.logSeq, len(tt.want))
+			}
+			if len(tt.want) > 0 && kvs.logTail != logHash(tt.want[len(tt.want)-1]) {
+				t.Errorf("last entry hashed to %s, want %s", kvs.logTail, logHash(tt.want[len(tt.want)-1]))
+			}
+
+			// The next entry from the leader follows the last whole line
+			conn, other := net.Pipe()
+			defer conn.Close()
+			defer other.Close()
+			kvs.leaderConn = conn
+			next := logLine("d", "1", 13)
+			if err := kvs.appendReplica(conn, kvs.logSeq+1, next); err != nil {
+				t.Fatalf("appending after loading: %v", err)
+			}
+			want := append(tt.want, next)
+			if lines := logLines(t, kvs); strings.Join(lines, "\n") != strings.Join(want, "\n") {
+				t.Errorf("log holds %q, want %q", lines, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+// Package dirlock keeps two processes from sharing a data directory.
+//
+// The lock is a file named LOCK in the directory, locked by the operating
+// system for as long as it is held open. The system drops the lock when the
+// process exits, even on a crash, so a stale lock file never keeps a
+// process from restarting. The file holds the pid of its owner, only to
+// tell whoever runs into the lock who holds it.
+package dirlock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errLocked is returned by lockFile when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// Lock creates dir if needed and takes an exclusive lock on it. The
+// returned file must be kept open, and so locked, for as long as the
+// process uses the directory.
+func Lock(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "LOCK"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(file)
+	if err == errLocked {
+		owner, _ := os.ReadFile(file.Name())
+		file.Close()
+		return nil, fmt.Errorf("it is in use by another process (pid %s)", strings.TrimSpace(string(owner)))
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return file, nil
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package dirlock
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on file without waiting for it.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+//go:build windows
+
+package dirlock
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errLockViolation syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// lockFile takes an exclusive LockFileEx lock on file without waiting for
+// it. The locked byte lies far past the pid written at the start, so others
+// can still read who holds the lock.
+func lockFile(file *os.File) error {
+	overlapped := syscall.Overlapped{OffsetHigh: 1}
+	ok, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 {
+		return nil
+	}
+	if err == errLockViolation {
+		return errLocked
+	}
+	return err
+}
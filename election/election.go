@@ -0,0 +1,535 @@
+// Package election makes sure a single master leads the cluster at a time.
+//
+// The master and the backup masters elect their leader the way Raft does.
+// Time is divided into numbered terms, each with at most one leader. A node
+// that hears nothing from a leader for an election timeout asks the others
+// to vote for it in the next term, and leads once a majority, itself
+// included, has. Every node votes at most once per term, and keeps its
+// vote on disk so a restart can't make it vote twice. It only votes for
+// candidates whose log is at least as up to date as its own: its last entry
+// is from a later term, or from the same term and the log is at least as
+// long. A former leader holding entries no one else took can't win on the
+// length of its log alone and then overwrite what the newer leaders logged.
+//
+// Before asking for votes a candidate asks whether it would get them (a
+// pre-vote). Nodes that have heard from a leader recently say no, so a node
+// that was cut off, or has just restarted, can't depose a working leader by
+// turning up with a higher term.
+//
+// The leader sends everyone a heartbeat several times per election timeout.
+// Heartbeats carry its term, so a former leader that comes back learns of
+// the newer term and steps down. A node that accepts a heartbeat votes for
+// nobody else for the shortest election timeout after, so once a majority
+// has answered a heartbeat no other leader can be elected until that long
+// after it was sent. The leader holds a lease for that time, less a margin
+// (see leaseTimeout), and steps down the moment its lease runs out without
+// a newer heartbeat being answered: by then the others may have elected
+// someone else, and two leaders must never both take writes.
+package election
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kvstore/protocol"
+)
+
+const (
+	HeartbeatInterval  = 200 * time.Millisecond
+	MinElectionTimeout = 1 * time.Second
+	MaxElectionTimeout = 2 * time.Second
+
+	rpcTimeout = HeartbeatInterval
+
+	// leaseTimeout is how long after a heartbeat is sent the leader may
+	// count on a majority that answered it not to elect anyone else. The
+	// margin below MinElectionTimeout covers clocks running at slightly
+	// different rates and the time between the leader checking its lease
+	// and acting on it.
+	leaseTimeout = MinElectionTimeout - 2*rpcTimeout
+)
+
+// Role is what a node currently does in the election.
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Candidate:
+		return "CANDIDATE"
+	case Leader:
+		return "LEADER"
+	}
+	return "FOLLOWER"
+}
+
+// State is a node's view of the election.
+type State struct {
+	Role   Role
+	Term   uint64
+	Leader string // address of the leader of Term, "" if not known yet
+}
+
+// Config describes a node and the cluster it is part of.
+type Config struct {
+	Self      string                       // this node's address, at which clients, slaves and peers reach it
+	Peers     []string                     // the other nodes' addresses
+	StateFile string                       // where the current term and vote are kept
+	LastLog   func() (term, length uint64) // the term of the last entry in this node's log, and how many it holds
+
+	// OnChange is called with every new state, one call at a time and in
+	// order, but not from the goroutine that changed it.
+	OnChange func(State)
+}
+
+// Node takes part in elections on behalf of one master.
+type Node struct {
+	cfg   Config
+	peers []*peer
+
+	mu       sync.Mutex
+	state    State
+	votedFor string        // who we voted for in state.Term, "" for nobody
+	heard    time.Time     // when a leader last reached us, or we last voted
+	acked    time.Time     // as leader, when the last heartbeat a majority answered was sent
+	lease    *time.Timer   // as leader, steps us down when our lease runs out
+	timeout  time.Duration // how long to wait for a leader before standing
+	changes  chan State
+}
+
+// New returns a follower in the term it last knew of, as kept in
+// cfg.StateFile.
+func New(cfg Config) (*Node, error) {
+	n := &Node{cfg: cfg, heard: time.Now(), changes: make(chan State, 64)}
+	for _, addr := range cfg.Peers {
+		n.peers = append(n.peers, &peer{addr: addr})
+	}
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+	n.resetTimeout()
+	return n, nil
+}
+
+// Start runs the node until the process exits.
+func (n *Node) Start() {
+	go n.deliver()
+	go n.run()
+}
+
+// State returns the node's current view of the election.
+func (n *Node) State() State {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state
+}
+
+// Leading reports whether this node is the leader.
+func (n *Node) Leading() bool {
+	return n.State().Role == Leader
+}
+
+// HoldsLease reports whether this node is the leader and a majority has
+// answered one of its heartbeats recently enough that no other leader can
+// have been elected since. Only then may it act as the leader towards
+// clients.
+func (n *Node) HoldsLease() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state.Role == Leader && time.Since(n.acked) < leaseTimeout
+}
+
+// load reads the term and vote kept by an earlier run, if any.
+func (n *Node) load() error {
+	data, err := os.ReadFile(n.cfg.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	n.state.Term, err = strconv.ParseUint(lines[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad election state in %s: %v", n.cfg.StateFile, err)
+	}
+	if len(lines) > 1 {
+		n.votedFor = lines[1]
+	}
+	return nil
+}
+
+// save keeps the term and vote on disk. Callers hold mu.
+func (n *Node) save() error {
+	data := strconv.FormatUint(n.state.Term, 10) + "\n" + n.votedFor + "\n"
+	err := os.WriteFile(n.cfg.StateFile+".tmp", []byte(data), 0644)
+	if err == nil {
+		err = os.Rename(n.cfg.StateFile+".tmp", n.cfg.StateFile)
+	}
+	return err
+}
+
+// setState moves to a new state and queues it for OnChange. Callers hold
+// mu.
+func (n *Node) setState(state State) {
+	if state == n.state {
+		return
+	}
+	n.state = state
+	n.changes <- state
+}
+
+func (n *Node) deliver() {
+	for state := range n.changes {
+		if n.cfg.OnChange != nil {
+			n.cfg.OnChange(state)
+		}
+	}
+}
+
+// resetTimeout picks a new election timeout, different on every node so
+// they rarely stand at the same time. Callers hold mu, or own n alone.
+func (n *Node) resetTimeout() {
+	n.heard = time.Now()
+	n.timeout = MinElectionTimeout + time.Duration(rand.Int63n(int64(MaxElectionTimeout-MinElectionTimeout)))
+}
+
+// majority is how many nodes, this one included, make a majority.
+func (n *Node) majority() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) run() {
+	for {
+		n.mu.Lock()
+		role, quiet, timeout := n.state.Role, time.Since(n.heard), n.timeout
+		n.mu.Unlock()
+
+		switch {
+		case role == Leader:
+			start := time.Now()
+			n.heartbeat()
+			time.Sleep(HeartbeatInterval - time.Since(start))
+		case quiet >= timeout:
+			n.campaign()
+		default:
+			time.Sleep(min(timeout-quiet, HeartbeatInterval))
+		}
+	}
+}
+
+// campaign stands for leader in the next term, if a pre-vote says a
+// majority would have us.
+func (n *Node) campaign() {
+	lastTerm, logLength := n.cfg.LastLog()
+	n.mu.Lock()
+	n.resetTimeout()
+	next := n.state.Term + 1
+	n.mu.Unlock()
+
+	if !n.poll(next, lastTerm, logLength, true) {
+		return
+	}
+
+	n.mu.Lock()
+	if n.state.Term >= next {
+		// A leader or another candidate got there first
+		n.mu.Unlock()
+		return
+	}
+	n.votedFor = n.cfg.Self
+	if err := n.save(); err != nil {
+		n.mu.Unlock()
+		return
+	}
+	n.setState(State{Role: Candidate, Term: next})
+	n.mu.Unlock()
+
+	if !n.poll(next, lastTerm, logLength, false) {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state.Role == Candidate && n.state.Term == next {
+		// Votes don't keep their givers from voting again in a later term,
+		// so the lease only starts with the first heartbeat a majority
+		// answers
+		n.acked = time.Time{}
+		n.setState(State{Role: Leader, Term: next, Leader: n.cfg.Self})
+		n.startLease(leaseTimeout)
+	}
+}
+
+// poll asks every peer for its vote in term and reports whether a majority
+// gave it.
+func (n *Node) poll(term, lastTerm, logLength uint64, pre bool) bool {
+	votes := 1
+	for reply := range n.broadcast(protocol.OpVote, strconv.FormatUint(term, 10), n.cfg.Self,
+		strconv.FormatUint(lastTerm, 10), strconv.FormatUint(logLength, 10), strconv.FormatBool(pre)) {
+		if reply.granted {
+			votes++
+		} else {
+			// Catch up with a newer term, so our next try isn't turned
+			// down for being behind
+			n.observe(reply.term)
+		}
+	}
+	return votes >= n.majority()
+}
+
+// heartbeat asserts our leadership over every peer, renewing our lease as
+// soon as a majority has answered. We step down if one of them knows of a
+// newer term; the lease timer steps us down if a majority stays silent.
+func (n *Node) heartbeat() {
+	n.mu.Lock()
+	term := n.state.Term
+	n.mu.Unlock()
+
+	// Peers take the heartbeat no earlier than this, so the lease counts
+	// from here rather than from when their answers come back
+	sent := time.Now()
+	acks := 1
+	if acks >= n.majority() {
+		n.renewLease(term, sent)
+	}
+	for reply := range n.broadcast(protocol.OpLead, strconv.FormatUint(term, 10), n.cfg.Self) {
+		if !reply.granted {
+			n.observe(reply.term)
+			continue
+		}
+		acks++
+		if acks == n.majority() {
+			n.renewLease(term, sent)
+		}
+	}
+}
+
+// renewLease extends our lease as leader of term to leaseTimeout after
+// sent, when a heartbeat that a majority has now answered went out.
+func (n *Node) renewLease(term uint64, sent time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state.Role != Leader || n.state.Term != term || sent.Before(n.acked) {
+		return
+	}
+	n.acked = sent
+	n.startLease(time.Until(sent.Add(leaseTimeout)))
+}
+
+// startLease (re)sets the timer that steps us down once our lease has run
+// out, after d. Callers hold mu.
+func (n *Node) startLease(d time.Duration) {
+	if n.lease != nil {
+		n.lease.Stop()
+	}
+	term := n.state.Term
+	n.lease = time.AfterFunc(d, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		// A later renewal may have beaten the timer to the lock
+		if n.state.Role != Leader || n.state.Term != term || time.Since(n.acked) < leaseTimeout {
+			return
+		}
+		n.resetTimeout()
+		n.setState(State{Role: Follower, Term: term})
+	})
+}
+
+// observe moves on to term if it is newer than ours, as a follower that
+// doesn't know the leader yet.
+func (n *Node) observe(term uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if term <= n.state.Term {
+		return
+	}
+	n.state.Term, n.votedFor = term, ""
+	n.save()
+	n.resetTimeout()
+	n.setState(State{Role: Follower, Term: term})
+}
+
+// Serve answers a peer's vote requests and heartbeats on conn until it
+// closes. conn has already been introduced with HELLO PEER.
+func (n *Node) Serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		args, err := frame.Args()
+		var reply protocol.Frame
+		switch {
+		case err != nil:
+			reply = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+		case frame.Op == protocol.OpVote && len(args) == 5:
+			term, _ := strconv.ParseUint(args[0], 10, 64)
+			lastTerm, _ := strconv.ParseUint(args[2], 10, 64)
+			logLength, _ := strconv.ParseUint(args[3], 10, 64)
+			pre, _ := strconv.ParseBool(args[4])
+			current, granted := n.vote(term, args[1], lastTerm, logLength, pre)
+			reply = protocol.NewFrame(protocol.OpOK, frame.ReqID, strconv.FormatUint(current, 10), strconv.FormatBool(granted))
+		case frame.Op == protocol.OpLead && len(args) == 2:
+			term, _ := strconv.ParseUint(args[0], 10, 64)
+			current, accepted := n.follow(term, args[1])
+			reply = protocol.NewFrame(protocol.OpOK, frame.ReqID, strconv.FormatUint(current, 10), strconv.FormatBool(accepted))
+		default:
+			reply = protocol.NewFrame(protocol.OpError, frame.ReqID, "expected VOTE or LEAD")
+		}
+		conn.SetWriteDeadline(time.Now().Add(rpcTimeout))
+		if err := protocol.WriteFrame(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// vote answers a candidate's request for our vote in term, returning our
+// term and whether we give it. The candidate's log ends with an entry from
+// lastTerm and holds logLength entries. A pre-vote changes nothing here.
+func (n *Node) vote(term uint64, candidate string, lastTerm, logLength uint64, pre bool) (uint64, bool) {
+	ourTerm, ourLength := n.cfg.LastLog()
+	upToDate := lastTerm > ourTerm || lastTerm == ourTerm && logLength >= ourLength
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// A leader we heard from recently, or we ourselves, still leads
+	if n.state.Role == Leader || n.state.Leader != "" && time.Since(n.heard) < MinElectionTimeout {
+		return n.state.Term, false
+	}
+	if pre {
+		return n.state.Term, term > n.state.Term && upToDate
+	}
+	if term < n.state.Term {
+		return n.state.Term, false
+	}
+	if term > n.state.Term {
+		n.state.Term, n.votedFor = term, ""
+		n.setState(State{Role: Follower, Term: term})
+	}
+	granted := (n.votedFor == "" || n.votedFor == candidate) && upToDate
+	if granted {
+		n.votedFor = candidate
+	}
+	if err := n.save(); err != nil {
+		return n.state.Term, false
+	}
+	if granted {
+		n.resetTimeout()
+	}
+	return n.state.Term, granted
+}
+
+// follow takes a heartbeat from the leader of term, returning our term and
+// whether we accept it as leader.
+func (n *Node) follow(term uint64, leader string) (uint64, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if term < n.state.Term {
+		return n.state.Term, false
+	}
+	if term > n.state.Term {
+		n.state.Term, n.votedFor = term, ""
+		n.save()
+	}
+	n.resetTimeout()
+	n.setState(State{Role: Follower, Term: term, Leader: leader})
+	return term, true
+}
+
+// reply is a peer's answer to VOTE or LEAD.
+type reply struct {
+	term    uint64
+	granted bool
+}
+
+// broadcast sends the same request to every peer in parallel. The answers
+// of those that reply in time come out of the channel as they arrive; it
+// is closed once every peer has answered or timed out.
+func (n *Node) broadcast(op protocol.Op, args ...string) <-chan reply {
+	replies := make(chan reply, len(n.peers))
+	var wg sync.WaitGroup
+	for _, p := range n.peers {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			if r, err := p.call(op, args...); err == nil {
+				replies <- r
+			}
+		}(p)
+	}
+	go func() {
+		wg.Wait()
+		close(replies)
+	}()
+	return replies
+}
+
+// peer is another node, reached over a connection kept open between
+// requests.
+type peer struct {
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+	seq  uint32
+}
+
+// call sends one request to the peer and waits for its answer.
+func (p *peer) call(op protocol.Op, args ...string) (reply, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, err := p.roundTrip(op, args)
+	if err != nil && p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return r, err
+}
+
+func (p *peer) roundTrip(op protocol.Op, args []string) (reply, error) {
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.addr, rpcTimeout)
+		if err != nil {
+			return reply{}, err
+		}
+		p.conn = conn
+		p.conn.SetWriteDeadline(time.Now().Add(rpcTimeout))
+		if err := protocol.WriteFrame(p.conn, protocol.NewFrame(protocol.OpHello, 0, "PEER")); err != nil {
+			return reply{}, err
+		}
+	}
+
+	p.seq++
+	p.conn.SetDeadline(time.Now().Add(rpcTimeout))
+	if err := protocol.WriteFrame(p.conn, protocol.NewFrame(op, p.seq, args...)); err != nil {
+		return reply{}, err
+	}
+	frame, err := protocol.ReadFrame(p.conn)
+	if err != nil {
+		return reply{}, err
+	}
+	fields, err := frame.Args()
+	if err != nil || frame.Op != protocol.OpOK || len(fields) != 2 || frame.ReqID != p.seq {
+		return reply{}, fmt.Errorf("unexpected answer from %s: %s", p.addr, frame.Op)
+	}
+	term, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return reply{}, err
+	}
+	granted, _ := strconv.ParseBool(fields[1])
+	return reply{term: term, granted: granted}, nil
+}
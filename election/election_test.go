@@ -0,0 +1,225 @@
+package election
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"kvstore/protocol"
+)
+
+// newNode returns a node with no peers whose log ends with an entry from
+// lastTerm and holds length entries, keeping its state in stateFile ("" for
+// a fresh file).
+func newNode(t *testing.T, stateFile string, lastTerm, length uint64) *Node {
+	t.Helper()
+	if stateFile == "" {
+		stateFile = filepath.Join(t.TempDir(), "election.state")
+	}
+	n, err := New(Config{
+		Self:      "self",
+		StateFile: stateFile,
+		LastLog:   func() (uint64, uint64) { return lastTerm, length },
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return n
+}
+
+// ask sends n one request the way a peer would, through Serve, and returns
+// its answer.
+func ask(t *testing.T, n *Node, op protocol.Op, args ...string) (uint64, bool) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go n.Serve(server)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	if err := protocol.WriteFrame(client, protocol.NewFrame(op, 1, args...)); err != nil {
+		t.Fatalf("sending %s: %v", op, err)
+	}
+	frame, err := protocol.ReadFrame(client)
+	if err != nil {
+		t.Fatalf("reading the answer to %s: %v", op, err)
+	}
+	fields, err := frame.Args()
+	if err != nil || frame.Op != protocol.OpOK || len(fields) != 2 {
+		t.Fatalf("answer to %s = %s %q, %v", op, frame.Op, fields, err)
+	}
+	term, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		t.Fatalf("answer to %s: bad term %q", op, fields[0])
+	}
+	return term, fields[1] == "true"
+}
+
+// requestVote asks n for its vote, or pre-vote, for candidate in term.
+func requestVote(t *testing.T, n *Node, term uint64, candidate string, lastTerm, length uint64, pre bool) bool {
+	t.Helper()
+	_, granted := ask(t, n, protocol.OpVote, strconv.FormatUint(term, 10), candidate,
+		strconv.FormatUint(lastTerm, 10), strconv.FormatUint(length, 10), strconv.FormatBool(pre))
+	return granted
+}
+
+// heartbeat sends n a heartbeat from the leader of term.
+func heartbeat(t *testing.T, n *Node, term uint64, leader string) (uint64, bool) {
+	t.Helper()
+	return ask(t, n, protocol.OpLead, strconv.FormatUint(term, 10), leader)
+}
+
+// waitFor polls n until its state satisfies ok, failing after a second.
+func waitFor(t *testing.T, n *Node, ok func(State) bool) State {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		state := n.State()
+		if ok(state) {
+			return state
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state stayed %+v", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVoteUpToDate(t *testing.T) {
+	// The voter's log ends with an entry from term 2 and holds 5 entries
+	tests := []struct {
+		name     string
+		lastTerm uint64
+		length   uint64
+		want     bool
+	}{
+		{"later last term, shorter log", 3, 1, true},
+		{"same last term, same length", 2, 5, true},
+		{"same last term, longer log", 2, 6, true},
+		{"same last term, shorter log", 2, 4, false},
+		{"earlier last term, longer log", 1, 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, pre := range []bool{true, false} {
+				n := newNode(t, "", 2, 5)
+				if got := requestVote(t, n, 3, "candidate", tt.lastTerm, tt.length, pre); got != tt.want {
+					t.Errorf("vote (pre %v) for a log ending in term %d with %d entries = %v, want %v",
+						pre, tt.lastTerm, tt.length, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPreVoteRefusedWhileLeaderHeard(t *testing.T) {
+	n := newNode(t, "", 0, 0)
+	if _, ok := heartbeat(t, n, 1, "leader"); !ok {
+		t.Fatal("heartbeat from the leader of term 1 refused")
+	}
+	if requestVote(t, n, 2, "candidate", 1, 10, true) {
+		t.Fatal("pre-vote granted right after a heartbeat")
+	}
+
+	// Once the leader has been quiet for the shortest election timeout
+	n.mu.Lock()
+	n.heard = time.Now().Add(-MinElectionTimeout)
+	n.mu.Unlock()
+	if !requestVote(t, n, 2, "candidate", 1, 10, true) {
+		t.Fatal("pre-vote refused once the leader went quiet")
+	}
+	if state := n.State(); state.Term != 1 || state.Leader != "leader" {
+		t.Fatalf("a pre-vote changed the state to %+v", state)
+	}
+	if requestVote(t, n, 1, "candidate", 1, 10, true) {
+		t.Fatal("pre-vote granted for the current term")
+	}
+}
+
+func TestOneVotePerTerm(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "election.state")
+	n := newNode(t, stateFile, 0, 0)
+	if !requestVote(t, n, 2, "a", 0, 0, false) {
+		t.Fatal("first vote in term 2 refused")
+	}
+	if requestVote(t, n, 2, "b", 0, 0, false) {
+		t.Fatal("second vote in term 2 granted")
+	}
+
+	// A restart keeps the vote
+	n = newNode(t, stateFile, 0, 0)
+	if state := n.State(); state.Term != 2 {
+		t.Fatalf("term after restart = %d, want 2", state.Term)
+	}
+	if requestVote(t, n, 2, "b", 0, 0, false) {
+		t.Fatal("second vote in term 2 granted after a restart")
+	}
+	if !requestVote(t, n, 2, "a", 0, 0, false) {
+		t.Fatal("repeated vote for the same candidate refused after a restart")
+	}
+	if requestVote(t, n, 1, "b", 0, 0, false) {
+		t.Fatal("vote granted in an earlier term")
+	}
+	if !requestVote(t, n, 3, "b", 0, 0, false) {
+		t.Fatal("vote in a new term refused")
+	}
+}
+
+func TestLeaseExpiryStepsDown(t *testing.T) {
+	n := newNode(t, "", 0, 0)
+	n.campaign()
+	if state := n.State(); state.Role != Leader || state.Term != 1 {
+		t.Fatalf("state after standing alone = %+v, want leader of term 1", state)
+	}
+	if n.HoldsLease() {
+		t.Fatal("holds a lease before any heartbeat was answered")
+	}
+
+	// With no peers our own answer is a majority
+	n.heartbeat()
+	if !n.HoldsLease() {
+		t.Fatal("no lease after a heartbeat a majority answered")
+	}
+
+	// No more heartbeats go out, so the lease runs out
+	state := waitFor(t, n, func(s State) bool { return s.Role != Leader })
+	if state.Role != Follower || state.Term != 1 {
+		t.Fatalf("state after the lease ran out = %+v, want follower in term 1", state)
+	}
+	if n.HoldsLease() {
+		t.Fatal("holds a lease after stepping down")
+	}
+}
+
+func TestFollowDemotesStaleLeader(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "election.state")
+	n := newNode(t, stateFile, 0, 0)
+	n.campaign()
+	if !n.Leading() {
+		t.Fatal("not leading after standing alone")
+	}
+
+	// A heartbeat from an older term is turned down
+	if term, ok := heartbeat(t, n, 0, "old"); ok || term != 1 {
+		t.Fatalf("heartbeat of term 0 = %d, %v; want 1, false", term, ok)
+	}
+	if !n.Leading() {
+		t.Fatal("stepped down for a heartbeat of an older term")
+	}
+
+	// One from a newer term makes us follow its leader
+	if term, ok := heartbeat(t, n, 3, "new"); !ok || term != 3 {
+		t.Fatalf("heartbeat of term 3 = %d, %v; want 3, true", term, ok)
+	}
+	want := State{Role: Follower, Term: 3, Leader: "new"}
+	if state := n.State(); state != want {
+		t.Fatalf("state after a newer heartbeat = %+v, want %+v", state, want)
+	}
+	if n.HoldsLease() {
+		t.Fatal("holds a lease after stepping down")
+	}
+	if n := newNode(t, stateFile, 0, 0); n.State().Term != 3 {
+		t.Fatalf("term kept on disk = %d, want 3", n.State().Term)
+	}
+}
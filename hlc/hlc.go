@@ -0,0 +1,60 @@
+// Package hlc implements the hybrid logical clock the masters use to stamp
+// versions on keys.
+//
+// A timestamp packs the wall clock in Unix milliseconds into the high 48
+// bits and a logical counter into the low 16:
+//
+//	+------------------------------+----------------+
+//	| physical ms (48 bits)        | logical (16)   |
+//	+------------------------------+----------------+
+//
+// Timestamps from one clock strictly increase, even if the wall clock
+// stalls or steps back, and Observe lets a clock move past any version it
+// has seen elsewhere. A master that takes over from another therefore never
+// hands out a version lower than one already stored, as long as it has
+// seen the log or a slave holding it, and usually even when it has not.
+package hlc
+
+import (
+	"sync"
+	"time"
+)
+
+// logicalBits is how many low bits of a timestamp hold the logical counter.
+const logicalBits = 16
+
+// Clock hands out increasing timestamps. The zero value is ready to use.
+type Clock struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+// Now returns a timestamp greater than every one this clock has returned or
+// observed.
+func (c *Clock) Now() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	physical := uint64(time.Now().UnixMilli()) << logicalBits
+	if physical > c.last {
+		c.last = physical
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Observe moves the clock past ts, a timestamp seen elsewhere.
+func (c *Clock) Observe(ts uint64) {
+	c.mu.Lock()
+	if ts > c.last {
+		c.last = ts
+	}
+	c.mu.Unlock()
+}
+
+// At returns the smallest timestamp a clock can hand out when the wall
+// clock reads t, so every timestamp below it was handed out before t.
+func At(t time.Time) uint64 {
+	return uint64(t.UnixMilli()) << logicalBits
+}
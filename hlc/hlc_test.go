@@ -0,0 +1,90 @@
+package hlc
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNowIncreases(t *testing.T) {
+	var c Clock
+	last := c.Now()
+	for i := 0; i < 100000; i++ {
+		ts := c.Now()
+		if ts <= last {
+			t.Fatalf("Now() = %d after %d", ts, last)
+		}
+		last = ts
+	}
+}
+
+func TestNowTracksWallClock(t *testing.T) {
+	var c Clock
+	before := uint64(time.Now().UnixMilli())
+	ts := c.Now()
+	after := uint64(time.Now().UnixMilli())
+	if ms := ts >> logicalBits; ms < before || ms > after {
+		t.Fatalf("physical part %d outside [%d, %d]", ms, before, after)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	future := uint64(time.Now().Add(time.Hour).UnixMilli()) << logicalBits
+	tests := []struct {
+		name     string
+		observed uint64
+		want     func(ts uint64) bool
+	}{
+		{"future", future, func(ts uint64) bool { return ts == future+1 }},
+		{"future with counter", future | 5, func(ts uint64) bool { return ts == future|6 }},
+		{"past", 1 << logicalBits, func(ts uint64) bool { return ts > 1<<logicalBits }},
+		{"zero", 0, func(ts uint64) bool { return ts > 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Clock
+			c.Observe(tt.observed)
+			if ts := c.Now(); !tt.want(ts) || ts <= tt.observed {
+				t.Fatalf("Now() after Observe(%d) = %d", tt.observed, ts)
+			}
+		})
+	}
+}
+
+func TestAt(t *testing.T) {
+	var c Clock
+	before := At(time.Now())
+	ts := c.Now()
+	time.Sleep(2 * time.Millisecond)
+	after := At(time.Now())
+	if ts < before || ts >= after {
+		t.Fatalf("Now() = %d outside [At(before), At(after)) = [%d, %d)", ts, before, after)
+	}
+}
+
+func TestConcurrentNowUnique(t *testing.T) {
+	var c Clock
+	const workers, each = 8, 10000
+	results := make([][]uint64, workers)
+	var wg sync.WaitGroup
+	for w := range results {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				results[w] = append(results[w], c.Now())
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool, workers*each)
+	for _, stamps := range results {
+		for _, ts := range stamps {
+			if seen[ts] {
+				t.Fatalf("timestamp %d handed out twice", ts)
+			}
+			seen[ts] = true
+		}
+	}
+}
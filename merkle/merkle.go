@@ -0,0 +1,86 @@
+// Package merkle builds the hash trees slaves use for anti-entropy.
+//
+// Keys are spread over Leaves buckets by hash. A leaf's hash covers every
+// key in its bucket together with a description of the copy held (version,
+// expiry, tombstone); each inner node hashes its Fanout children, up to a
+// single root. Two slaves holding exactly the same copies of the same keys
+// have the same root, and where they differ, walking down the nodes whose
+// hashes disagree leads to the few buckets that need comparing key by key.
+//
+// Nodes are addressed by level and index: level 0 is the root, level Depth
+// the leaves, and the children of node i are i*Fanout to i*Fanout+Fanout-1
+// on the next level.
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+const (
+	Fanout = 16
+	Depth  = 2
+	Leaves = 256 // Fanout^Depth
+)
+
+// Leaf returns the bucket key falls into.
+func Leaf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % Leaves)
+}
+
+// Tree is a Merkle tree over a set of keys.
+type Tree struct {
+	levels [Depth + 1][][]byte
+}
+
+// Build hashes keys, which maps every key to a description of the copy
+// held. Equal copies must have equal descriptions.
+func Build(keys map[string]string) *Tree {
+	var buckets [Leaves][]string
+	for key := range keys {
+		leaf := Leaf(key)
+		buckets[leaf] = append(buckets[leaf], key)
+	}
+
+	t := &Tree{}
+	t.levels[Depth] = make([][]byte, Leaves)
+	for leaf, bucket := range buckets {
+		sort.Strings(bucket)
+		h := sha256.New()
+		for _, key := range bucket {
+			// Length prefixes keep ("ab", "c") apart from ("a", "bc")
+			h.Write(binary.AppendUvarint(nil, uint64(len(key))))
+			h.Write([]byte(key))
+			h.Write(binary.AppendUvarint(nil, uint64(len(keys[key]))))
+			h.Write([]byte(keys[key]))
+		}
+		t.levels[Depth][leaf] = h.Sum(nil)
+	}
+
+	for level := Depth - 1; level >= 0; level-- {
+		below := t.levels[level+1]
+		t.levels[level] = make([][]byte, len(below)/Fanout)
+		for i := range t.levels[level] {
+			h := sha256.New()
+			for _, child := range below[i*Fanout : (i+1)*Fanout] {
+				h.Write(child)
+			}
+			t.levels[level][i] = h.Sum(nil)
+		}
+	}
+	return t
+}
+
+// Hash returns the hash of a node as a hex string.
+func (t *Tree) Hash(level, index int) (string, error) {
+	if level < 0 || level > Depth || index < 0 || index >= len(t.levels[level]) {
+		return "", fmt.Errorf("no node %d on level %d", index, level)
+	}
+	return hex.EncodeToString(t.levels[level][index]), nil
+}
@@ -0,0 +1,129 @@
+package merkle
+
+import (
+	"strconv"
+	"testing"
+)
+
+func keys(n int, desc string) map[string]string {
+	m := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		m["key"+strconv.Itoa(i)] = desc
+	}
+	return m
+}
+
+// differing returns the leaves whose hashes differ between a and b.
+func differing(t *testing.T, a, b *Tree) []int {
+	t.Helper()
+	var leaves []int
+	for i := 0; i < Leaves; i++ {
+		ha, err := a.Hash(Depth, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hb, _ := b.Hash(Depth, i)
+		if ha != hb {
+			leaves = append(leaves, i)
+		}
+	}
+	return leaves
+}
+
+func TestBuild(t *testing.T) {
+	base := keys(1000, "v1")
+	tests := []struct {
+		name   string
+		change func(map[string]string)
+		leaves []int // the leaves that should differ from base
+	}{
+		{"same", func(map[string]string) {}, nil},
+		{"changed copy", func(m map[string]string) { m["key7"] = "v2" }, []int{Leaf("key7")}},
+		{"missing key", func(m map[string]string) { delete(m, "key42") }, []int{Leaf("key42")}},
+		{"extra key", func(m map[string]string) { m["new"] = "v1" }, []int{Leaf("new")}},
+		{"empty description", func(m map[string]string) { m["key3"] = "" }, []int{Leaf("key3")}},
+	}
+	want := Build(base)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := keys(1000, "v1")
+			tt.change(m)
+			got := Build(m)
+
+			leaves := differing(t, want, got)
+			if len(leaves) != len(tt.leaves) || (len(leaves) > 0 && leaves[0] != tt.leaves[0]) {
+				t.Fatalf("differing leaves %v, want %v", leaves, tt.leaves)
+			}
+			rootA, _ := want.Hash(0, 0)
+			rootB, _ := got.Hash(0, 0)
+			if (rootA == rootB) != (len(tt.leaves) == 0) {
+				t.Fatalf("roots equal = %v with %d differing leaves", rootA == rootB, len(tt.leaves))
+			}
+			if len(tt.leaves) > 0 {
+				// The inner node above the leaf must differ too
+				parent := tt.leaves[0] / Fanout
+				a, _ := want.Hash(Depth-1, parent)
+				b, _ := got.Hash(Depth-1, parent)
+				if a == b {
+					t.Fatalf("parent %d of leaf %d has the same hash", parent, tt.leaves[0])
+				}
+			}
+		})
+	}
+}
+
+func TestBuildBoundaries(t *testing.T) {
+	// A key and description that run together the same way as another
+	// key in the same bucket and its description must not collide
+	suffix := 0
+	for Leaf("a"+strconv.Itoa(suffix)) != Leaf("a") {
+		suffix++
+	}
+	s := strconv.Itoa(suffix)
+	a := Build(map[string]string{"a": s + "v"})
+	b := Build(map[string]string{"a" + s: "v"})
+	ra, _ := a.Hash(0, 0)
+	rb, _ := b.Hash(0, 0)
+	if ra == rb {
+		t.Fatalf("{a: %sv} and {a%s: v} have the same root", s, s)
+	}
+
+	// Empty trees agree with each other
+	e1, _ := Build(nil).Hash(0, 0)
+	e2, _ := Build(map[string]string{}).Hash(0, 0)
+	if e1 != e2 {
+		t.Fatal("empty trees differ")
+	}
+}
+
+func TestHashBounds(t *testing.T) {
+	tree := Build(keys(10, "v"))
+	tests := []struct {
+		level, index int
+		ok           bool
+	}{
+		{0, 0, true},
+		{0, 1, false},
+		{1, Fanout - 1, true},
+		{1, Fanout, false},
+		{Depth, Leaves - 1, true},
+		{Depth, Leaves, false},
+		{Depth + 1, 0, false},
+		{-1, 0, false},
+		{Depth, -1, false},
+	}
+	for _, tt := range tests {
+		h, err := tree.Hash(tt.level, tt.index)
+		if (err == nil) != tt.ok {
+			t.Errorf("Hash(%d, %d) = %q, %v, want ok %v", tt.level, tt.index, h, err, tt.ok)
+		}
+	}
+}
+
+func TestLeafRange(t *testing.T) {
+	for i := 0; i < 10000; i++ {
+		if leaf := Leaf(strconv.Itoa(i)); leaf < 0 || leaf >= Leaves {
+			t.Fatalf("Leaf(%d) = %d", i, leaf)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Package oplog defines the line format of kv_store.log, the operation log
+// the master appends to and the backup master replays.
+//
+// Each operation is one line: the operation name followed by its key and
+// value quoted with strconv.Quote, the key's expiry time and its version,
+// e.g.
+//
+//	WRITE "user:1" "{\"name\": \"ada\"}\n" 1735689600000 7
+//
+// The expiry is an absolute Unix time in milliseconds (0 means the key never
+// expires) so replaying the log later cannot bring an expired key back.
+//
+// Entries in kv_store.log end with one more field, the election term of the
+// leader that logged them, which the masters compare when they vote:
+//
+//	WRITE "user:1" "{\"name\": \"ada\"}\n" 1735689600000 7 3
+//
+// Entries without a term (in other files, inside a TXN record, or from logs
+// written before terms were kept) leave the field out.
+//
+// Quoting keeps every entry on a single line no matter what bytes the key
+// or value contain.
+//
+// A committed transaction is a single TXN record whose key is the
+// transaction ID and whose value holds all of its operations (see
+// FormatTxn), so a reader sees either the whole transaction or none of it.
+package oplog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is one logged operation.
+type Entry struct {
+	Op        string
+	Key       string
+	Value     string
+	ExpiresAt int64 // Unix milliseconds, 0 for no expiry
+	Version   uint64
+	Term      uint64 // election term of the leader that logged it, 0 for none
+}
+
+// Expired reports whether the entry's deadline has passed at now.
+func (e Entry) Expired(now time.Time) bool {
+	return e.ExpiresAt != 0 && now.UnixMilli() >= e.ExpiresAt
+}
+
+// Format renders e as a log line, without the trailing newline.
+func Format(e Entry) string {
+	line := e.Op + " " + strconv.Quote(e.Key) + " " + strconv.Quote(e.Value) + " " +
+		strconv.FormatInt(e.ExpiresAt, 10) + " " + strconv.FormatUint(e.Version, 10)
+	if e.Term != 0 {
+		line += " " + strconv.FormatUint(e.Term, 10)
+	}
+	return line
+}
+
+// Parse decodes a line produced by Format. Lines from logs written before
+// values were quoted ("WRITE key value") are accepted as well.
+func Parse(line string) (Entry, error) {
+	fields, err := splitFields(line)
+	if err != nil {
+		return Entry{}, err
+	}
+	if len(fields) < 3 {
+		return Entry{}, fmt.Errorf("short log entry: %q", line)
+	}
+	entry := Entry{Op: fields[0], Key: fields[1], Value: fields[2]}
+	if len(fields) > 3 {
+		entry.ExpiresAt, err = strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return Entry{}, fmt.Errorf("bad expiry in log entry: %v", err)
+		}
+	}
+	if len(fields) > 4 {
+		entry.Version, err = strconv.ParseUint(fields[4], 10, 64)
+		if err != nil {
+			return Entry{}, fmt.Errorf("bad version in log entry: %v", err)
+		}
+	}
+	if len(fields) > 5 {
+		entry.Term, err = strconv.ParseUint(fields[5], 10, 64)
+		if err != nil {
+			return Entry{}, fmt.Errorf("bad term in log entry: %v", err)
+		}
+	}
+	return entry, nil
+}
+
+// FormatTxn packs the operations of a transaction into the value of a TXN
+// record, one formatted entry per line.
+func FormatTxn(ops []Entry) string {
+	lines := make([]string, len(ops))
+	for i, op := range ops {
+		lines[i] = Format(op)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParseTxn is the inverse of FormatTxn.
+func ParseTxn(value string) ([]Entry, error) {
+	var ops []Entry
+	for _, line := range strings.Split(value, "\n") {
+		if line == "" {
+			continue
+		}
+		op, err := Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// splitFields breaks a line into space separated fields, unquoting any
+// field that starts with a double quote.
+func splitFields(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted field in log entry: %v", err)
+			}
+			field, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			line = line[len(quoted):]
+			continue
+		}
+		end := strings.IndexByte(line, ' ')
+		if end < 0 {
+			end = len(line)
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+}
@@ -0,0 +1,111 @@
+package oplog
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatParseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry Entry
+	}{
+		{"plain", Entry{Op: "WRITE", Key: "user:1", Value: "ada", Version: 7}},
+		{"empty value", Entry{Op: "DELETE", Key: "k", Version: 1}},
+		{"empty key", Entry{Op: "WRITE", Value: "v"}},
+		{"spaces", Entry{Op: "WRITE", Key: "a key", Value: " padded  value "}},
+		{"quotes and newlines", Entry{Op: "WRITE", Key: `"k"`, Value: "{\"name\": \"ada\"}\nnext line\r\n"}},
+		{"backslashes", Entry{Op: "WRITE", Key: `C:\dir\`, Value: `\"\\`}},
+		{"control and invalid utf-8", Entry{Op: "WRITE", Key: "\x00\x01", Value: "\xff\xfe\t"}},
+		{"unicode", Entry{Op: "APPEND", Key: "ключ", Value: "値 🙂"}},
+		{"expiry", Entry{Op: "EXPIRE", Key: "k", ExpiresAt: 1735689600000, Version: 1 << 40}},
+		{"max version", Entry{Op: "PERSIST", Key: "k", Version: ^uint64(0)}},
+		{"term", Entry{Op: "WRITE", Key: "k", Value: "v", Version: 9, Term: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := Format(tt.entry)
+			if strings.ContainsAny(line, "\n\r") {
+				t.Fatalf("Format(%+v) = %q spans more than one line", tt.entry, line)
+			}
+			got, err := Parse(line)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", line, err)
+			}
+			if got != tt.entry {
+				t.Fatalf("Parse(Format(e)) = %+v, want %+v", got, tt.entry)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    Entry
+		wantErr bool
+	}{
+		{line: "WRITE key value", want: Entry{Op: "WRITE", Key: "key", Value: "value"}},
+		{line: `WRITE "k" "v" 5`, want: Entry{Op: "WRITE", Key: "k", Value: "v", ExpiresAt: 5}},
+		{line: `WRITE  "k"   "v"  0  3`, want: Entry{Op: "WRITE", Key: "k", Value: "v", Version: 3}},
+		{line: `TXN "t1" "" 0 3 2`, want: Entry{Op: "TXN", Key: "t1", Version: 3, Term: 2}},
+		{line: "", wantErr: true},
+		{line: `WRITE "k"`, wantErr: true},
+		{line: `WRITE "unterminated v 0 1`, wantErr: true},
+		{line: `WRITE "k" "v" soon 1`, wantErr: true},
+		{line: `WRITE "k" "v" 0 -1`, wantErr: true},
+		{line: `WRITE "k" "v" 0 1 x`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.line)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %+v, want an error", tt.line, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", tt.line, got, err, tt.want)
+		}
+	}
+}
+
+func TestTxnRoundTrip(t *testing.T) {
+	ops := []Entry{
+		{Op: "WRITE", Key: "a", Value: "multi\nline", Version: 1},
+		{Op: "DELETE", Key: "b", Version: 2},
+		{Op: "WRITE", Key: "c d", Value: `"q"`, ExpiresAt: 99, Version: 3},
+	}
+	record := Entry{Op: "TXN", Key: "tx-1", Value: FormatTxn(ops), Version: 3}
+	parsed, err := Parse(Format(record))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	got, err := ParseTxn(parsed.Value)
+	if err != nil {
+		t.Fatalf("ParseTxn: %v", err)
+	}
+	if !reflect.DeepEqual(got, ops) {
+		t.Fatalf("ParseTxn = %+v, want %+v", got, ops)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.UnixMilli(1000)
+	tests := []struct {
+		expiresAt int64
+		want      bool
+	}{
+		{0, false},
+		{999, true},
+		{1000, true},
+		{1001, false},
+	}
+	for _, tt := range tests {
+		if got := (Entry{ExpiresAt: tt.expiresAt}).Expired(now); got != tt.want {
+			t.Errorf("Expired with ExpiresAt %d = %v, want %v", tt.expiresAt, got, tt.want)
+		}
+	}
+}
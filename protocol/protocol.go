@@ -0,0 +1,256 @@
+// Package protocol implements the framed wire format spoken between the
+// client, master, backup master and slave processes.
+//
+// Every message is sent as a single frame:
+//
+//	+----------------+-----------+------------------+-----------+
+//	| length (4B BE) | op (1B)   | request ID (4B)  | payload   |
+//	+----------------+-----------+------------------+-----------+
+//
+// The length counts everything after the length field itself, so a reader
+// always knows exactly how many bytes belong to the current message no
+// matter how TCP splits or coalesces the stream.
+//
+// Payloads are a sequence of arguments, each prefixed with its length as an
+// unsigned varint. Arguments are opaque byte strings: spaces, newlines and
+// NUL bytes in keys or values are carried through untouched.
+//
+// Expiry times sent to slaves are absolute Unix milliseconds, "0" meaning
+// the key never expires. Clients only ever send relative TTLs in seconds;
+// the master turns those into deadlines.
+//
+// Every write and delete carries a per-key version assigned by the master.
+// Versions are hybrid logical clock timestamps (see package hlc), so they
+// keep increasing across a failover, and wherever copies of a key disagree
+// the one with the highest version wins. Version 0 means the key does not
+// exist; a CAS expecting version 0 succeeds only if the key is currently
+// absent.
+//
+// Consistency levels are ONE, QUORUM, ALL or a replica count. Without one
+// the master uses its configured default. OK replies to WRITE and DELETE
+// end with the number of replicas that acknowledged.
+//
+// Transactions reach slaves in two steps: PREPARE stages every change and
+// COMMIT applies them all at once, so a slave never exposes half of one. A
+// slave that reconnects with transactions still prepared lists their IDs in
+// its HELLO, and the master commits those it has logged and aborts the rest.
+//
+// A master keeps the requests a slave misses while unreachable (hints) and
+// replays them, in order, when a slave with the same node ID says HELLO
+// again.
+//
+// Masters PING every connected slave at a fixed interval and slaves answer
+// PONG, echoing the request ID. A slave that stays silent is first
+// suspected, then declared down and dropped. A slave that has been idle for
+// a long time PINGs its master the same way.
+//
+// The master and the backup masters elect a leader among themselves (see
+// package election) over connections opened with HELLO PEER, on which
+// candidates ask for VOTEs and the leader sends LEAD heartbeats. Only the
+// leader serves clients and slaves. The others answer a client's HELLO, or
+// any request, with REDIRECT and close the connection. The leader answers
+// a client's HELLO with OK.
+//
+// The leader replicates its log to every other master over TCP. It says
+// HELLO MASTER with its term, the follower answers OK with how many log
+// entries it holds and a hash of the last one, and the leader streams the
+// rest as LOG frames numbered from 1, followed by every new entry as it is
+// logged. The follower acknowledges each entry once it is on disk. If the
+// follower's log has entries the leader's lacks, the stream starts over at
+// 1 and the follower drops what it had.
+//
+// For anti-entropy the master walks the slaves' Merkle trees (see package
+// merkle) with HASHES, one level at a time, then fetches the keys of the
+// leaves that differ with BUCKET and writes the newest copies back. Trees
+// cover one partition of the ring (see package ring) at a time, its ranges
+// sent as start-end hash pairs, and are compared between the slaves that
+// hold it. A slave builds each tree once per round, named by the master.
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Op identifies what a frame carries.
+type Op byte
+
+const (
+	OpHello Op = iota + 1 // first frame on a connection: CLIENT, SLAVE, MASTER or PEER; slaves follow with their node ID and prepared transaction IDs, the leader's log stream with its term
+	OpPing
+	OpPong
+	OpRead    // key[, consistency level]
+	OpWrite   // client: key, value[, ttl seconds ("" for none)[, consistency level]]; to slaves: key, value, expiry, version
+	OpDelete  // client: key[, consistency level]; to slaves: key, version
+	OpExpire  // client: key, ttl seconds; to slaves: key, expiry, version, version of the value it applies to
+	OpPersist // client: key; to slaves: key, version, version of the value it applies to
+	OpCAS     // key, expected version, value[, ttl seconds]
+	OpSetNX   // key, value[, ttl seconds]
+	OpIncrBy  // key, delta; replies with the new value
+	OpDecrBy  // key, delta; replies with the new value
+	OpAppend  // key, suffix; replies OK with version and new length
+	OpMGet    // key...; replies VALUES
+	OpMSet    // client: consistency level ("" for the default), key, value, ...; to slaves: key, value, expiry, version, ...; replies OK with key, version pairs
+	OpExec    // op, key, value for each command of a transaction (WRITE, DELETE, or CHECK with a version as value)
+	OpPrepare // txn ID, then op, key, value, expiry, version for each change; the slave holds it without applying
+	OpCommit  // txn ID; apply a prepared transaction
+	OpAbort   // txn ID; drop a prepared transaction
+	OpScan    // cursor, end, prefix, count: keys >= cursor and < end ("" for no end) with prefix, in order; replies PAGE (slaves reply VALUES, tombstones included)
+	OpStats   // no args; replies OK with name, value pairs of the master's counters
+	OpHashes  // round, ring ranges, level, node index...: hashes of those Merkle tree nodes over the slave's keys in the ranges; replies OK with one hash per node
+	OpBucket  // ring ranges ("" for all), leaf index...: every key in those ranges and Merkle leaves, tombstones included; replies OK with key, found, value, expiry, version for each
+	OpHealth  // no args; replies OK with node ID, state (UP, SUSPECT or DOWN), address, milliseconds since last heard for each slave
+	OpLog     // sequence number, kv_store.log line: the next entry of the leader's log, streamed to a follower; replies OK with the sequence number
+	OpVote    // term, candidate address, term of the candidate's last log entry, its log length, "true" for a pre-vote; replies OK with the voter's term and whether it votes for the candidate
+	OpLead    // term, leader address: the leader's heartbeat; replies OK with the follower's term and whether it accepts the leader
+
+	// Replies
+	OpOK       // request applied; args are informational
+	OpValue    // args: key, value, version, then the expiry (from slaves) or how many replicas answered (to clients)
+	OpNotFound // args: key (to the master also the tombstone version, if any)
+	OpError    // args: message
+	OpConflict // args: key, current version; a CAS or SETNX precondition failed
+	OpValues   // args: key, found ("1" or "0"), value, version for every key asked for
+	OpPage     // args: next cursor ("" once the scan is complete), then key, value, version for each key
+	OpRedirect // args: address of the leader, "" if not known yet; sent by a master that isn't the leader, which then closes the connection
+)
+
+var opNames = map[Op]string{
+	OpHello:   "HELLO",
+	OpPing:    "PING",
+	OpPong:    "PONG",
+	OpRead:    "READ",
+	OpWrite:   "WRITE",
+	OpDelete:  "DELETE",
+	OpExpire:  "EXPIRE",
+	OpPersist: "PERSIST",
+	OpCAS:     "CAS",
+	OpSetNX:   "SETNX",
+	OpIncrBy:  "INCRBY",
+	OpDecrBy:  "DECRBY",
+	OpAppend:  "APPEND",
+	OpMGet:    "MGET",
+	OpMSet:    "MSET",
+	OpExec:    "EXEC",
+	OpPrepare: "PREPARE",
+	OpCommit:  "COMMIT",
+	OpAbort:   "ABORT",
+	OpScan:    "SCAN",
+	OpStats:   "STATS",
+	OpHashes:  "HASHES",
+	OpBucket:  "BUCKET",
+	OpHealth:  "HEALTH",
+	OpLog:     "LOG",
+	OpVote:    "VOTE",
+	OpLead:    "LEAD",
+
+	OpOK:       "OK",
+	OpValue:    "VALUE",
+	OpNotFound: "NOT_FOUND",
+	OpError:    "ERROR",
+	OpConflict: "CONFLICT",
+	OpValues:   "VALUES",
+	OpPage:     "PAGE",
+	OpRedirect: "REDIRECT",
+}
+
+func (op Op) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP(%d)", byte(op))
+}
+
+// headerSize is the number of bytes that follow the length prefix before
+// the payload starts (opcode + request ID).
+const headerSize = 1 + 4
+
+// MaxFrameSize bounds the length prefix so a corrupt or hostile peer cannot
+// make us allocate arbitrary amounts of memory.
+const MaxFrameSize = 64 << 20
+
+// Frame is one message on the wire. ReqID is chosen by the sender of a
+// request and echoed back unchanged in the reply so callers can match
+// responses to requests.
+type Frame struct {
+	Op      Op
+	ReqID   uint32
+	Payload []byte
+}
+
+// NewFrame builds a frame whose payload is args encoded with EncodeArgs.
+func NewFrame(op Op, reqID uint32, args ...string) Frame {
+	return Frame{Op: op, ReqID: reqID, Payload: EncodeArgs(args...)}
+}
+
+// Args decodes the frame payload into its arguments.
+func (f Frame) Args() ([]string, error) {
+	return DecodeArgs(f.Payload)
+}
+
+// EncodeArgs packs args into a payload, each one preceded by its length.
+func EncodeArgs(args ...string) []byte {
+	size := 0
+	for _, arg := range args {
+		size += binary.MaxVarintLen64 + len(arg)
+	}
+	buf := make([]byte, 0, size)
+	for _, arg := range args {
+		buf = binary.AppendUvarint(buf, uint64(len(arg)))
+		buf = append(buf, arg...)
+	}
+	return buf
+}
+
+// DecodeArgs is the inverse of EncodeArgs.
+func DecodeArgs(payload []byte) ([]string, error) {
+	var args []string
+	for len(payload) > 0 {
+		n, width := binary.Uvarint(payload)
+		if width <= 0 || n > uint64(len(payload)-width) {
+			return nil, fmt.Errorf("malformed argument %d", len(args))
+		}
+		payload = payload[width:]
+		args = append(args, string(payload[:n]))
+		payload = payload[n:]
+	}
+	return args, nil
+}
+
+// WriteFrame encodes f and writes it to w with a single Write call.
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Payload)+headerSize > MaxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", len(f.Payload))
+	}
+	buf := make([]byte, 4+headerSize+len(f.Payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(headerSize+len(f.Payload)))
+	buf[4] = byte(f.Op)
+	binary.BigEndian.PutUint32(buf[5:9], f.ReqID)
+	copy(buf[9:], f.Payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads exactly one frame from r, blocking until the whole frame
+// has arrived.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return Frame{}, err
+	}
+	length := binary.BigEndian.Uint32(lenBuf[:])
+	if length < headerSize || length > MaxFrameSize {
+		return Frame{}, fmt.Errorf("invalid frame length %d", length)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Frame{}, err
+	}
+	return Frame{
+		Op:      Op(buf[0]),
+		ReqID:   binary.BigEndian.Uint32(buf[1:5]),
+		Payload: buf[headerSize:],
+	}, nil
+}
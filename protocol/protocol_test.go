@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame Frame
+	}{
+		{"no args", NewFrame(OpPing, 1)},
+		{"empty arg", NewFrame(OpWrite, 2, "key", "")},
+		{"binary", NewFrame(OpWrite, 3, "k\x00ey", "line\nbreak \"quoted\"")},
+		{"large arg", NewFrame(OpValue, 1<<31, "key", strings.Repeat("x", 1<<16))},
+		{"many args", NewFrame(OpMSet, 5, "a", "1", "b", "2", "c", "3")},
+	}
+	readers := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{"whole", func(r io.Reader) io.Reader { return r }},
+		{"one byte at a time", iotest.OneByteReader},
+		{"half reads", iotest.HalfReader},
+	}
+	for _, tt := range tests {
+		for _, rd := range readers {
+			t.Run(tt.name+"/"+rd.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := WriteFrame(&buf, tt.frame); err != nil {
+					t.Fatalf("WriteFrame: %v", err)
+				}
+				got, err := ReadFrame(rd.wrap(&buf))
+				if err != nil {
+					t.Fatalf("ReadFrame: %v", err)
+				}
+				if got.Op != tt.frame.Op || got.ReqID != tt.frame.ReqID || !bytes.Equal(got.Payload, tt.frame.Payload) {
+					t.Fatalf("got %v %d %q, want %v %d %q", got.Op, got.ReqID, got.Payload, tt.frame.Op, tt.frame.ReqID, tt.frame.Payload)
+				}
+				want, _ := tt.frame.Args()
+				args, err := got.Args()
+				if err != nil || !slices.Equal(args, want) {
+					t.Fatalf("Args() = %q, %v, want %q", args, err, want)
+				}
+				if buf.Len() != 0 {
+					t.Fatalf("%d bytes left unread", buf.Len())
+				}
+			})
+		}
+	}
+}
+
+func TestReadFrameSequence(t *testing.T) {
+	var buf bytes.Buffer
+	for i := uint32(0); i < 3; i++ {
+		WriteFrame(&buf, NewFrame(OpRead, i, "key"))
+	}
+	r := iotest.OneByteReader(&buf)
+	for i := uint32(0); i < 3; i++ {
+		f, err := ReadFrame(r)
+		if err != nil || f.ReqID != i {
+			t.Fatalf("frame %d: got ReqID %d, %v", i, f.ReqID, err)
+		}
+	}
+	if _, err := ReadFrame(r); err != io.EOF {
+		t.Fatalf("after the last frame got %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	var whole bytes.Buffer
+	WriteFrame(&whole, NewFrame(OpWrite, 7, "key", "value"))
+	frame := whole.Bytes()
+
+	length := func(n uint32) []byte { return binary.BigEndian.AppendUint32(nil, n) }
+	tests := []struct {
+		name  string
+		input []byte
+		want  error // nil for any error
+	}{
+		{"empty", nil, io.EOF},
+		{"cut in length", frame[:2], io.ErrUnexpectedEOF},
+		{"cut in header", frame[:6], io.ErrUnexpectedEOF},
+		{"cut in payload", frame[:len(frame)-1], io.ErrUnexpectedEOF},
+		{"length below header", length(headerSize - 1), nil},
+		{"length above max", length(MaxFrameSize + 1), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadFrame(iotest.OneByteReader(bytes.NewReader(tt.input)))
+			if err == nil {
+				t.Fatal("ReadFrame succeeded")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeArgsMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"length past end", []byte{5, 'a', 'b'}},
+		{"second arg cut", append(EncodeArgs("key"), 3, 'v')},
+		{"unterminated varint", []byte{0x80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if args, err := DecodeArgs(tt.payload); err == nil {
+				t.Fatalf("DecodeArgs(%v) = %q, want an error", tt.payload, args)
+			}
+		})
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	f := Frame{Op: OpWrite, Payload: make([]byte, MaxFrameSize)}
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, f); err == nil {
+		t.Fatal("WriteFrame accepted a frame over MaxFrameSize")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("WriteFrame wrote %d bytes of a rejected frame", buf.Len())
+	}
+}
@@ -0,0 +1,239 @@
+// Package ring places keys on slaves by consistent hashing.
+//
+// Every node (a slave, by its node ID) is hashed onto a circle of 2^64
+// points VNodes times, once per virtual node. A key hashes onto the same
+// circle, and its replicas are the first n distinct nodes found walking
+// clockwise from there. The placement depends only on the set of node IDs,
+// so every master that knows the same slaves computes the same replicas
+// without keeping anything per key. Adding or removing a node only moves
+// the keys next to its virtual nodes, about 1/len(nodes) of them, and
+// spreads them over all the other nodes rather than onto a single
+// neighbour.
+package ring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// VNodes is how many points each node gets on the circle by default.
+const VNodes = 64
+
+// Ring is a consistent hashing ring. It is safe for concurrent use.
+type Ring struct {
+	mu     sync.RWMutex
+	vnodes int
+	points []point // sorted by hash, then node
+	nodes  map[string]bool
+}
+
+// point is one virtual node on the circle.
+type point struct {
+	hash uint64
+	node string
+}
+
+// New returns an empty ring giving each node vnodes points.
+func New(vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	return &Ring{vnodes: vnodes, nodes: make(map[string]bool)}
+}
+
+// Hash is where key (or a virtual node) sits on the circle.
+func Hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Add puts node on the ring and reports whether it was not there yet.
+func (r *Ring) Add(node string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nodes[node] {
+		return false
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.vnodes; i++ {
+		r.points = append(r.points, point{hash: Hash(node + "#" + strconv.Itoa(i)), node: node})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+	return true
+}
+
+// Remove takes node off the ring and reports whether it was there.
+func (r *Ring) Remove(node string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.nodes[node] {
+		return false
+	}
+	delete(r.nodes, node)
+	kept := r.points[:0]
+	for _, p := range r.points {
+		if p.node != node {
+			kept = append(kept, p)
+		}
+	}
+	r.points = kept
+	return true
+}
+
+// Has reports whether node is on the ring.
+func (r *Ring) Has(node string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nodes[node]
+}
+
+// Len returns how many nodes are on the ring.
+func (r *Ring) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.nodes)
+}
+
+// Lookup returns the n nodes that hold key, in order of preference: the
+// first n distinct nodes clockwise from the key's hash. There are fewer if
+// the ring has fewer than n nodes.
+func (r *Ring) Lookup(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+
+	h := Hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	return r.walk(start, n)
+}
+
+// walk returns the first n distinct nodes from point start on. Callers
+// hold r.mu and make sure there are n nodes.
+func (r *Ring) walk(start, n int) []string {
+	owners := make([]string, 0, n)
+	for i := 0; len(owners) < n; i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if !slices.Contains(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+// Range is an arc of the circle: the hashes after Start up to and
+// including End, wrapping past zero if End is not after Start.
+type Range struct {
+	Start, End uint64
+}
+
+// Contains reports whether h falls in r.
+func (r Range) Contains(h uint64) bool {
+	if r.Start < r.End {
+		return h > r.Start && h <= r.End
+	}
+	return h > r.Start || h <= r.End
+}
+
+// Partition is a part of the circle, made of one or more arcs, whose keys
+// are all held by the same nodes.
+type Partition struct {
+	Owners []string // sorted
+	Ranges []Range
+}
+
+// Partitions splits the circle by which n nodes hold the keys on each arc,
+// so nodes that ought to hold the same keys can be compared on just those.
+// Every key falls in exactly one partition.
+func (r *Ring) Partitions(n int) []Partition {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+
+	byOwners := make(map[string]int)
+	var parts []Partition
+	for i, p := range r.points {
+		// A key belongs to the first point at or after its hash, so each
+		// point ends the arc that starts at the point before it
+		prev := r.points[(i+len(r.points)-1)%len(r.points)].hash
+		if prev == p.hash && len(r.points) > 1 {
+			continue
+		}
+		owners := r.walk(i, n)
+		slices.Sort(owners)
+		id := strings.Join(owners, "\x00")
+		j, seen := byOwners[id]
+		if !seen {
+			j = len(parts)
+			byOwners[id] = j
+			parts = append(parts, Partition{Owners: owners})
+		}
+		parts[j].Ranges = append(parts[j].Ranges, Range{Start: prev, End: p.hash})
+	}
+	return parts
+}
+
+// InRanges reports whether key falls in any of ranges. No ranges at all
+// stands for the whole circle.
+func InRanges(key string, ranges []Range) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	h := Hash(key)
+	for _, r := range ranges {
+		if r.Contains(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatRanges renders ranges for the wire as start-end pairs separated by
+// commas.
+func FormatRanges(ranges []Range) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = strconv.FormatUint(r.Start, 10) + "-" + strconv.FormatUint(r.End, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseRanges is the inverse of FormatRanges.
+func ParseRanges(s string) ([]Range, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ranges []Range
+	for _, part := range strings.Split(s, ",") {
+		start, end, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("bad range %q", part)
+		}
+		var r Range
+		var err error
+		if r.Start, err = strconv.ParseUint(start, 10, 64); err != nil {
+			return nil, fmt.Errorf("bad range %q", part)
+		}
+		if r.End, err = strconv.ParseUint(end, 10, 64); err != nil {
+			return nil, fmt.Errorf("bad range %q", part)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
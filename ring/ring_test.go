@@ -0,0 +1,172 @@
+package ring
+
+import (
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func newRing(nodes ...string) *Ring {
+	r := New(VNodes)
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []string
+		n     int
+		want  int
+	}{
+		{"empty ring", nil, 3, 0},
+		{"zero replicas", []string{"a", "b"}, 0, 0},
+		{"fewer nodes than replicas", []string{"a", "b"}, 3, 2},
+		{"one node", []string{"a"}, 1, 1},
+		{"all nodes", []string{"a", "b", "c"}, 3, 3},
+		{"some nodes", []string{"a", "b", "c", "d", "e"}, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRing(tt.nodes...)
+			for i := 0; i < 200; i++ {
+				owners := r.Lookup("key"+strconv.Itoa(i), tt.n)
+				if len(owners) != tt.want {
+					t.Fatalf("Lookup = %v, want %d nodes", owners, tt.want)
+				}
+				sorted := slices.Clone(owners)
+				slices.Sort(sorted)
+				if len(slices.Compact(sorted)) != len(owners) {
+					t.Fatalf("Lookup = %v repeats a node", owners)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupIndependentOfOrder(t *testing.T) {
+	a := newRing("s1", "s2", "s3", "s4")
+	b := newRing("s4", "s2", "s1", "s3")
+	for i := 0; i < 500; i++ {
+		key := "key" + strconv.Itoa(i)
+		if got, want := b.Lookup(key, 2), a.Lookup(key, 2); !slices.Equal(got, want) {
+			t.Fatalf("Lookup(%q) = %v in one ring, %v in the other", key, got, want)
+		}
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	r := newRing("a", "b", "c")
+	if r.Add("a") {
+		t.Fatal("Add of a node already there reported true")
+	}
+	if r.Remove("d") {
+		t.Fatal("Remove of a missing node reported true")
+	}
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		before[key] = r.Lookup(key, 1)[0]
+	}
+	if !r.Remove("b") || r.Has("b") || r.Len() != 2 {
+		t.Fatal("Remove did not take b off the ring")
+	}
+	for key, owner := range before {
+		got := r.Lookup(key, 1)[0]
+		if owner != "b" && got != owner {
+			t.Fatalf("%q moved from %s to %s when b left", key, owner, got)
+		}
+		if got == "b" {
+			t.Fatalf("%q still placed on b", key)
+		}
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []string
+		n     int
+	}{
+		{"one node", []string{"a"}, 1},
+		{"two nodes", []string{"a", "b"}, 2},
+		{"five nodes, two replicas", []string{"a", "b", "c", "d", "e"}, 2},
+		{"five nodes, three replicas", []string{"a", "b", "c", "d", "e"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRing(tt.nodes...)
+			parts := r.Partitions(tt.n)
+			for i := 0; i < 2000; i++ {
+				key := "key" + strconv.Itoa(i)
+				want := r.Lookup(key, tt.n)
+				slices.Sort(want)
+				matches := 0
+				for _, p := range parts {
+					if InRanges(key, p.Ranges) {
+						matches++
+						if !slices.Equal(p.Owners, want) {
+							t.Fatalf("%q is in the partition of %v, Lookup says %v", key, p.Owners, want)
+						}
+					}
+				}
+				if matches != 1 {
+					t.Fatalf("%q falls in %d partitions", key, matches)
+				}
+			}
+		})
+	}
+	if parts := New(VNodes).Partitions(2); parts != nil {
+		t.Fatalf("Partitions of an empty ring = %v", parts)
+	}
+}
+
+func TestRangeContains(t *testing.T) {
+	const max = ^uint64(0)
+	tests := []struct {
+		r    Range
+		h    uint64
+		want bool
+	}{
+		{Range{10, 20}, 10, false},
+		{Range{10, 20}, 11, true},
+		{Range{10, 20}, 20, true},
+		{Range{10, 20}, 21, false},
+		{Range{max - 5, 5}, max, true},
+		{Range{max - 5, 5}, 0, true},
+		{Range{max - 5, 5}, 5, true},
+		{Range{max - 5, 5}, 6, false},
+		{Range{max - 5, 5}, max - 5, false},
+		{Range{7, 7}, 7, true}, // the whole circle
+		{Range{7, 7}, 8, true},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Contains(tt.h); got != tt.want {
+			t.Errorf("%v.Contains(%d) = %v, want %v", tt.r, tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestRangesRoundTrip(t *testing.T) {
+	tests := [][]Range{
+		nil,
+		{{1, 2}},
+		{{0, ^uint64(0)}, {^uint64(0) - 1, 3}},
+	}
+	for _, ranges := range tests {
+		s := FormatRanges(ranges)
+		got, err := ParseRanges(s)
+		if err != nil || !reflect.DeepEqual(got, ranges) {
+			t.Errorf("ParseRanges(%q) = %v, %v, want %v", s, got, err, ranges)
+		}
+	}
+	for _, bad := range []string{"1", "1-", "-2", "a-b", "1-2,", "1-2,3"} {
+		if ranges, err := ParseRanges(bad); err == nil {
+			t.Errorf("ParseRanges(%q) = %v, want an error", bad, ranges)
+		}
+	}
+}
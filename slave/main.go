@@ -1,26 +1,354 @@
 package main
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"kvstore/dirlock"
+	"kvstore/merkle"
+	"kvstore/oplog"
+	"kvstore/protocol"
+	"kvstore/ring"
+	"kvstore/storage"
+)
+
+// entry is what the slave holds for a key. Deleted keys are kept as
+// tombstones so a read never falls through to an older copy elsewhere.
+type entry = storage.Entry
+
+// Where the slave's data is kept, chosen with -engine
+var data_store storage.Engine
+
+// must stops the slave on a storage error. A slave that cannot read or
+// persist its data must not go on answering as if it could.
+func must(err error) {
+	if err != nil {
+		fmt.Printf("Storage error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// keyLockStripes is how many mutexes keep requests for the same key from
+// interleaving; every key hashes onto one of them.
+const keyLockStripes = 256
+
+// Requests are served in parallel. A request that reads a key and then
+// changes it holds the key's lock in between.
+var key_locks [keyLockStripes]sync.Mutex
+
+// lockKeys takes the locks for every key given and returns the function
+// that releases them. Stripes are locked in ascending order so two requests
+// can never deadlock each other.
+func lockKeys(keys ...string) func() {
+	stripes := make(map[uint32]bool)
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		stripes[h.Sum32()%keyLockStripes] = true
+	}
+	order := make([]int, 0, len(stripes))
+	for stripe := range stripes {
+		order = append(order, int(stripe))
+	}
+	sort.Ints(order)
+
+	for _, stripe := range order {
+		key_locks[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range order {
+			key_locks[stripe].Unlock()
+		}
+	}
+}
+
+// lookup returns what the slave holds for key and whether it is live.
+// Expired entries are turned into tombstones on the way, which frees the
+// value but keeps the version. Callers hold the key's lock.
+func lookup(key string) (entry, bool) {
+	stored, exists, err := data_store.Get(key)
+	must(err)
+	if !exists {
+		return entry{}, false
+	}
+	if !stored.Deleted && !stored.Live(time.Now()) {
+		stored = entry{Deleted: true, Version: stored.Version}
+		must(data_store.Put(key, stored))
+	}
+	return stored, stored.Live(time.Now())
+}
+
+// read is lookup for callers that don't hold the key's lock.
+func read(key string) (entry, bool) {
+	unlock := lockKeys(key)
+	defer unlock()
+	return lookup(key)
+}
+
+// store saves e under key unless we already hold a newer version. A read
+// repair can reach us after a later write to the same key; it must not undo
+// that write. Callers hold the key's lock.
+func store(key string, e entry) {
+	current, exists, err := data_store.Get(key)
+	must(err)
+	if exists && current.Version > e.Version {
+		return
+	}
+	must(data_store.Put(key, e))
+	changed()
+}
+
+// remove leaves a tombstone at version under key, unless we already hold a
+// newer version. Callers hold the key's lock.
+func remove(key string, version uint64) {
+	current, exists, err := data_store.Get(key)
+	must(err)
+	if exists && current.Version > version {
+		return
+	}
+	must(data_store.Delete(key, version))
+	changed()
+}
+
+// scan returns up to limit keys, live or not, that are >= start, < end (if
+// end is set) and carry prefix, in order.
+func scan(start, end, prefix string, limit int) []string {
+	keys, err := data_store.Scan(start, end, prefix, limit)
+	must(err)
+	return keys
+}
+
+// heldKeys describes what we hold of every key, tombstones included, for
+// the Merkle trees. Tombstones old enough to be dropped at the next
+// snapshot are left out, so a slave that has dropped one and a slave that
+// hasn't yet don't look out of sync.
+func heldKeys() map[string]string {
+	before := tombstonesBefore()
+	keys := make(map[string]string)
+	for _, key := range scan("", "", "", 0) {
+		stored, _ := read(key)
+		if stored.Deleted && stored.Version < before {
+			continue
+		}
+		keys[key] = fmt.Sprintf("%d %d %t", stored.Version, stored.ExpiresAt, stored.Deleted)
+	}
+	return keys
+}
+
+// merkleTree hashes the keys in held that fall in ranges (every key if
+// there are none), so the master can find the keys on which we disagree
+// with the other slaves holding those ranges.
+func merkleTree(held map[string]string, ranges []ring.Range) *merkle.Tree {
+	keys := make(map[string]string)
+	for key, state := range held {
+		if ring.InRanges(key, ranges) {
+			keys[key] = state
+		}
+	}
+	return merkle.Build(keys)
+}
+
+// The trees built for the master's current anti-entropy round, by the
+// ranges they cover. A round asks for several levels of each tree, which
+// are all answered from one build, and for the trees of every partition we
+// hold, which are all built from one scan of our keys.
+var (
+	tree_mutex sync.Mutex
+	tree_round string
+	tree_keys  map[string]string // what we held when the round began, see heldKeys
+	tree_cache map[string]*merkle.Tree
 )
 
-// Global map to store key-value pairs
-var data_store map[string]string = make(map[string]string)
+// roundTree returns the tree over ranges for the given round, building it
+// on first use. Trees of earlier rounds are dropped.
+func roundTree(round, ranges string) (*merkle.Tree, error) {
+	tree_mutex.Lock()
+	defer tree_mutex.Unlock()
+	if round != tree_round {
+		tree_round, tree_keys, tree_cache = round, nil, make(map[string]*merkle.Tree)
+	}
+	if tree, ok := tree_cache[ranges]; ok {
+		return tree, nil
+	}
+	parsed, err := ring.ParseRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
+	if tree_keys == nil {
+		tree_keys = heldKeys()
+	}
+	tree := merkleTree(tree_keys, parsed)
+	tree_cache[ranges] = tree
+	return tree, nil
+}
+
+// hashes answers a HASHES request: round, ranges, level, then the nodes
+// wanted on that level.
+func hashes(reqID uint32, parts []string) protocol.Frame {
+	if len(parts) < 3 {
+		return protocol.NewFrame(protocol.OpError, reqID, "expected round, ranges and level")
+	}
+	level, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return protocol.NewFrame(protocol.OpError, reqID, "invalid level")
+	}
+	tree, err := roundTree(parts[0], parts[1])
+	if err != nil {
+		return protocol.NewFrame(protocol.OpError, reqID, err.Error())
+	}
+	values := make([]string, 0, len(parts)-3)
+	for _, node := range parts[3:] {
+		index, _ := strconv.Atoi(node)
+		hash, err := tree.Hash(level, index)
+		if err != nil {
+			return protocol.NewFrame(protocol.OpError, reqID, err.Error())
+		}
+		values = append(values, hash)
+	}
+	return protocol.NewFrame(protocol.OpOK, reqID, values...)
+}
+
+// staged is one change of a prepared transaction.
+type staged struct {
+	key   string
+	entry entry
+}
+
+// Transactions prepared by a master but not yet committed or aborted. They
+// outlive the connection so the next master can settle them.
+var prepared_txns map[string][]staged = make(map[string][]staged)
+
+// txn_mutex guards prepared_txns and the journal they are kept in.
+var txn_mutex sync.Mutex
+
+// prepare holds a transaction's changes until it is settled.
+func prepare(txnID string, changes []staged) {
+	txn_mutex.Lock()
+	defer txn_mutex.Unlock()
+	prepared_txns[txnID] = changes
+	logTxn(preparedRecord(txnID, changes))
+}
+
+// settle commits or aborts a prepared transaction and reports whether there
+// was one. A commit holds the locks of all its keys while it applies them,
+// so no read ever sees part of a transaction.
+func settle(txnID string, commit bool) bool {
+	txn_mutex.Lock()
+	defer txn_mutex.Unlock()
+	changes, exists := prepared_txns[txnID]
+	if !exists {
+		return false
+	}
+	if commit {
+		keys := make([]string, len(changes))
+		for i, change := range changes {
+			keys[i] = change.key
+		}
+		unlock := lockKeys(keys...)
+		for _, change := range changes {
+			store(change.key, change.entry)
+		}
+		unlock()
+	}
+	delete(prepared_txns, txnID)
+	logTxn(oplog.Entry{Op: "DONE", Key: txnID})
+	return true
+}
+
+// node_id tells masters that a reconnecting slave is the same one as
+// before, so they can replay the requests it missed while away and give it
+// back its place on the ring. It is kept in the data directory, so it also
+// survives restarts.
+var node_id string
+
+func newNodeID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// loadNodeID reads our node ID from the data directory, creating one the
+// first time the directory is used.
+func loadNodeID() (string, error) {
+	path := filepath.Join(data_dir, "node_id")
+	data, err := os.ReadFile(path)
+	if id := strings.TrimSpace(string(data)); err == nil && id != "" {
+		return id, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id := newNodeID()
+	err = os.MkdirAll(data_dir, 0755)
+	if err == nil {
+		err = os.WriteFile(path+".tmp", []byte(id+"\n"), 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return id, err
+}
+
+// data_lock is the lock file in the data directory (see dirlock), held
+// open, and so locked, for as long as we run. A second slave started with
+// the same -data refuses to run rather than sharing our files and node ID.
+var data_lock *os.File
+
+// hello introduces us to a master with our node ID, listing the
+// transactions we still hold prepared so it can tell us what became of them.
+func hello() protocol.Frame {
+	args := []string{"SLAVE", node_id}
+	txn_mutex.Lock()
+	for txnID := range prepared_txns {
+		args = append(args, txnID)
+	}
+	txn_mutex.Unlock()
+	return protocol.NewFrame(protocol.OpHello, 0, args...)
+}
+
+// leader_hint is the leader named by the last master that redirected us
+var leader_hint string
 
 // Try to connect to either master or backup server
 func connectToServer() net.Conn {
 	primaryMaster := "localhost:12345"
 	backupMaster := [3]string{"localhost:12346","localhost:12347","localhost:12348"}
 	
+	// A master that redirected us named the leader; try it first
+	if leader_hint != "" {
+		hint := leader_hint
+		leader_hint = ""
+		fmt.Printf("Attempting to connect to leader at %s\n", hint)
+		conn, err := net.DialTimeout("tcp", hint, 5*time.Second)
+		if err == nil {
+			err = protocol.WriteFrame(conn, hello())
+			if err == nil {
+				fmt.Println("Connected to leader", hint)
+				return conn
+			}
+			conn.Close()
+		}
+	}
+	
 	// Try primary master first
 	fmt.Printf("Attempting to connect to primary master at %s\n", primaryMaster)
 	conn, err := net.DialTimeout("tcp", primaryMaster, 5*time.Second)
 	if err == nil {
 		fmt.Println("Connected to Primary Master Server")
-		_, err = conn.Write([]byte("SLAVE"))
+		err = protocol.WriteFrame(conn, hello())
 		if err == nil {
 			return conn
 		}
@@ -33,7 +361,7 @@ func connectToServer() net.Conn {
 		conn, err = net.DialTimeout("tcp", backupMaster[i], 5*time.Second)
 		if err == nil {
 			fmt.Println("Connected to Backup Master Server",i)
-			_, err = conn.Write([]byte("SLAVE"))
+			err = protocol.WriteFrame(conn, hello())
 			if err == nil {
 				return conn
 			}
@@ -54,21 +382,28 @@ func handleMasterSession(conn net.Conn) bool {
 		return false
 	}
 	
+	// Replies are sent from several goroutines, and so are PINGs
+	var writeMu sync.Mutex
+	reader := bufio.NewReader(conn)
 	for {
-		buf := make([]byte, 1024)
-		n, err := conn.Read(buf)
+		// Wait for the first byte of the next frame separately, so an idle
+		// timeout never leaves us with half a frame consumed.
+		_, err := reader.Peek(1)
 		if err != nil {
 			netErr, ok := err.(net.Error)
 			if ok && netErr.Timeout() {
 				fmt.Println("Read timeout - master may still be connected")
 				// Ping the master to see if it's still alive
+				writeMu.Lock()
 				err = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
 				if err != nil {
+					writeMu.Unlock()
 					fmt.Printf("Error setting write deadline: %v\n", err)
 					return false
 				}
 				
-				_, err = conn.Write([]byte("PING"))
+				err = protocol.WriteFrame(conn, protocol.Frame{Op: protocol.OpPing})
+				writeMu.Unlock()
 				if err != nil {
 					fmt.Printf("Failed to ping master: %v\n", err)
 					return false
@@ -87,75 +422,306 @@ func handleMasterSession(conn net.Conn) bool {
 			}
 		}
 		
-		if n == 0 {
-			fmt.Println("Received empty message, connection may be closed")
+		// The rest of the frame is already on its way; give it a fresh
+		// deadline rather than whatever is left of the idle one.
+		err = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		if err != nil {
+			fmt.Printf("Error resetting read deadline: %v\n", err)
 			return false
 		}
 		
-		// Reset read deadline after successful read
-		err = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		frame, err := protocol.ReadFrame(reader)
 		if err != nil {
-			fmt.Printf("Error resetting read deadline: %v\n", err)
+			fmt.Printf("Connection error: %v\n", err)
 			return false
 		}
 		
-		command := string(buf[:n])
-		fmt.Printf("Received from master: %s\n", command)
+		// A master that isn't the leader tells us which one is and
+		// hangs up
+		if frame.Op == protocol.OpRedirect {
+			args, _ := frame.Args()
+			if len(args) > 0 {
+				leader_hint = args[0]
+			}
+			fmt.Printf("Master is not the leader, redirected to %q\n", leader_hint)
+			return true
+		}
 		
 		// Handle PING response
-		if command == "PONG" {
+		if frame.Op == protocol.OpPong {
 			fmt.Println("Received PONG from master - connection still active")
 			continue
 		}
 		
-		// Parse the command
-		parts := strings.Split(command, " ")
-		if len(parts) < 3 {
-			fmt.Printf("Invalid command format: %s\n", command)
+		// The master's heartbeat is answered straight away, however busy
+		// the other goroutines are, so it doesn't take us for dead
+		if frame.Op == protocol.OpPing {
+			writeMu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			err = protocol.WriteFrame(conn, protocol.Frame{Op: protocol.OpPong, ReqID: frame.ReqID})
+			writeMu.Unlock()
+			if err != nil {
+				fmt.Printf("Failed to answer heartbeat: %v\n", err)
+				return false
+			}
 			continue
 		}
 		
-		cmd, key, value := parts[0], parts[1], parts[2]
-		fmt.Printf("Processing command: %s %s %s\n", cmd, key, value)
+		// Each request is served on its own goroutine, so a slow one (a
+		// BUCKET over every key, say) doesn't hold up the rest. Replies
+		// carry their request's ID, so the master matches them up in
+		// whatever order they finish.
+		go serve(conn, &writeMu, frame)
+	}
+}
+
+// serve handles one request from a master and sends the reply.
+func serve(conn net.Conn, writeMu *sync.Mutex, frame protocol.Frame) {
+	response, ok := handleRequest(frame)
+	if !ok {
+		return
+	}
+	
+	writeMu.Lock()
+	err := conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err == nil {
+		err = protocol.WriteFrame(conn, response)
+	}
+	writeMu.Unlock()
+	if err != nil {
+		fmt.Printf("Error sending response: %v\n", err)
+		// The session's reader sees the closed connection and reconnects
+		conn.Close()
+		return
+	}
+	
+	fmt.Printf("Sent response: %s\n", response.Op)
+	maybeSnapshot()
+}
+
+// handleRequest applies one request from a master and returns the reply,
+// or false if there is nothing to reply.
+func handleRequest(frame protocol.Frame) (protocol.Frame, bool) {
+	// Parse the command
+	parts, err := frame.Args()
+	if err != nil || len(parts) < 1 {
+		fmt.Printf("Invalid command format: %v\n", err)
+		return protocol.Frame{}, false
+	}
+	fmt.Printf("Received from master: %s %q\n", frame.Op, parts)
+	
+	var response protocol.Frame
+	
+	switch frame.Op {
+	case protocol.OpRead:
+		key := parts[0]
+		stored, exists := read(key)
+		version := strconv.FormatUint(stored.Version, 10)
+		if exists {
+			expiresAt := strconv.FormatInt(stored.ExpiresAt, 10)
+			response = protocol.NewFrame(protocol.OpValue, frame.ReqID, key, stored.Value, version, expiresAt)
+		} else {
+			response = protocol.NewFrame(protocol.OpNotFound, frame.ReqID, key, version)
+		}
+		
+	case protocol.OpWrite:
+		if len(parts) < 2 {
+			fmt.Printf("Invalid command format: %q\n", parts)
+			return protocol.Frame{}, false
+		}
+		key, value := parts[0], parts[1]
+		var expiresAt int64
+		var version uint64
+		if len(parts) > 3 {
+			expiresAt, _ = strconv.ParseInt(parts[2], 10, 64)
+			version, _ = strconv.ParseUint(parts[3], 10, 64)
+		}
+		unlock := lockKeys(key)
+		store(key, entry{Value: value, ExpiresAt: expiresAt, Version: version})
+		unlock()
+		response = protocol.NewFrame(protocol.OpOK, frame.ReqID, key)
 		
-		var response string
+	case protocol.OpMGet:
+		// All the keys are locked together, so a transaction committing
+		// meanwhile is seen either whole or not at all.
+		unlock := lockKeys(parts...)
+		values := make([]string, 0, 4*len(parts))
+		for _, key := range parts {
+			stored, exists := lookup(key)
+			found := "0"
+			if exists {
+				found = "1"
+			}
+			values = append(values, key, found, stored.Value, strconv.FormatUint(stored.Version, 10))
+		}
+		unlock()
+		response = protocol.NewFrame(protocol.OpValues, frame.ReqID, values...)
 		
-		switch cmd {
-		case "READ":
-			storedValue, exists := data_store[key]
-			if !exists {
-				storedValue = "NOT FOUND"
+	case protocol.OpScan:
+		if len(parts) < 4 {
+			fmt.Printf("Invalid command format: %q\n", parts)
+			return protocol.Frame{}, false
+		}
+		limit, _ := strconv.Atoi(parts[3])
+		var values []string
+		for _, key := range scan(parts[0], parts[1], parts[2], limit) {
+			// Tombstones are included so the master can tell that a copy
+			// on another slave is out of date.
+			stored, exists := read(key)
+			found := "0"
+			if exists {
+				found = "1"
 			}
-			response = key + " " + storedValue
-			
-		case "WRITE":
-			data_store[key] = value
-			response = key + " " + value + " ACK"
-			
-		default:
-			fmt.Printf("Unknown command: %s\n", cmd)
-			continue
+			values = append(values, key, found, stored.Value, strconv.FormatUint(stored.Version, 10))
 		}
+		response = protocol.NewFrame(protocol.OpValues, frame.ReqID, values...)
 		
-		// Send response
-		err = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	case protocol.OpHashes:
+		response = hashes(frame.ReqID, parts)
+		
+	case protocol.OpBucket:
+		ranges, err := ring.ParseRanges(parts[0])
 		if err != nil {
-			fmt.Printf("Error setting write deadline: %v\n", err)
-			return false
+			response = protocol.NewFrame(protocol.OpError, frame.ReqID, err.Error())
+			break
 		}
+		wanted := make(map[int]bool)
+		for _, leaf := range parts[1:] {
+			index, _ := strconv.Atoi(leaf)
+			wanted[index] = true
+		}
+		var values []string
+		for _, key := range scan("", "", "", 0) {
+			if !wanted[merkle.Leaf(key)] || !ring.InRanges(key, ranges) {
+				continue
+			}
+			stored, exists := read(key)
+			found := "0"
+			if exists {
+				found = "1"
+			}
+			values = append(values, key, found, stored.Value, strconv.FormatInt(stored.ExpiresAt, 10), strconv.FormatUint(stored.Version, 10))
+		}
+		response = protocol.NewFrame(protocol.OpOK, frame.ReqID, values...)
 		
-		_, err = conn.Write([]byte(response))
-		if err != nil {
-			fmt.Printf("Error sending response: %v\n", err)
-			return false
+	case protocol.OpMSet:
+		keys := make([]string, 0, len(parts)/4)
+		for i := 0; i+3 < len(parts); i += 4 {
+			keys = append(keys, parts[i])
+		}
+		unlock := lockKeys(keys...)
+		for i := 0; i+3 < len(parts); i += 4 {
+			expiresAt, _ := strconv.ParseInt(parts[i+2], 10, 64)
+			version, _ := strconv.ParseUint(parts[i+3], 10, 64)
+			store(parts[i], entry{Value: parts[i+1], ExpiresAt: expiresAt, Version: version})
+		}
+		unlock()
+		response = protocol.NewFrame(protocol.OpOK, frame.ReqID)
+		
+	case protocol.OpPrepare:
+		var changes []staged
+		for i := 1; i+4 < len(parts); i += 5 {
+			expiresAt, _ := strconv.ParseInt(parts[i+3], 10, 64)
+			version, _ := strconv.ParseUint(parts[i+4], 10, 64)
+			changes = append(changes, staged{
+				key:   parts[i+1],
+				entry: entry{Value: parts[i+2], Deleted: parts[i] == "DELETE", ExpiresAt: expiresAt, Version: version},
+			})
 		}
+		prepare(parts[0], changes)
+		response = protocol.NewFrame(protocol.OpOK, frame.ReqID, parts[0])
 		
-		fmt.Printf("Sent response: %s\n", response)
+	case protocol.OpCommit, protocol.OpAbort:
+		txnID := parts[0]
+		if settle(txnID, frame.Op == protocol.OpCommit) {
+			response = protocol.NewFrame(protocol.OpOK, frame.ReqID, txnID)
+		} else {
+			response = protocol.NewFrame(protocol.OpNotFound, frame.ReqID, txnID)
+		}
+		
+	case protocol.OpDelete:
+		key := parts[0]
+		unlock := lockKeys(key)
+		_, exists := lookup(key)
+		var version uint64
+		if len(parts) > 1 {
+			version, _ = strconv.ParseUint(parts[1], 10, 64)
+		}
+		remove(key, version)
+		unlock()
+		// Either way the tombstone is now in place; the reply only tells
+		// the master whether there was a live value to remove.
+		if exists {
+			response = protocol.NewFrame(protocol.OpOK, frame.ReqID, key)
+		} else {
+			response = protocol.NewFrame(protocol.OpNotFound, frame.ReqID, key)
+		}
+		
+	case protocol.OpExpire, protocol.OpPersist:
+		key, rest := parts[0], parts[1:]
+		var expiresAt int64
+		if frame.Op == protocol.OpExpire && len(rest) > 0 {
+			expiresAt, _ = strconv.ParseInt(rest[0], 10, 64)
+			rest = rest[1:]
+		}
+		unlock := lockKeys(key)
+		stored, exists := lookup(key)
+		if !exists {
+			unlock()
+			response = protocol.NewFrame(protocol.OpNotFound, frame.ReqID, key)
+			break
+		}
+		// The change moves the value it was made for to a new version. A
+		// copy at any other version is stale (or already changed), and is
+		// left for repair rather than passed off as the new one.
+		if len(rest) >= 2 {
+			version, _ := strconv.ParseUint(rest[0], 10, 64)
+			base, _ := strconv.ParseUint(rest[1], 10, 64)
+			if stored.Version != base {
+				unlock()
+				response = protocol.NewFrame(protocol.OpOK, frame.ReqID, key)
+				break
+			}
+			stored.Version = version
+		}
+		stored.ExpiresAt = expiresAt
+		store(key, stored)
+		unlock()
+		response = protocol.NewFrame(protocol.OpOK, frame.ReqID, key)
+		
+	default:
+		fmt.Printf("Unknown command: %s\n", frame.Op)
+		return protocol.Frame{}, false
 	}
+	
+	return response, true
 }
 
 func main() {
 	fmt.Println("Starting Slave Server...")
+	engine := flag.String("engine", "log", "Storage engine: log (on disk) or memory (lost on exit)")
+	flag.StringVar(&data_dir, "data", "slave-data", "Directory for this slave's data; every slave needs its own")
+	flag.IntVar(&snapshot_every, "snapshot-every", 1000, "Number of changes after which a snapshot is taken")
+	flag.DurationVar(&tombstone_grace, "tombstone-grace", 2*time.Hour, "How long deleted keys are remembered; must exceed the masters' -hint-window (0 to keep them forever)")
+	flag.Parse()
+
+	var err error
+	data_lock, err = dirlock.Lock(data_dir)
+	if err != nil {
+		fmt.Printf("Error locking %s: %v\n", data_dir, err)
+		os.Exit(1)
+	}
+	err = openStorage(*engine)
+	if err != nil {
+		fmt.Printf("Error recovering data from %s: %v\n", data_dir, err)
+		os.Exit(1)
+	}
+	node_id, err = loadNodeID()
+	if err != nil {
+		fmt.Printf("Error reading node ID from %s: %v\n", data_dir, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Node ID %s\n", node_id)
 	
 	// Exponential backoff parameters
 	baseDelay := 5 * time.Second
@@ -0,0 +1,225 @@
+package main
+
+// The data itself is kept by the storage engine (see package storage).
+// Prepared transactions have to outlive a restart just like the data, or a
+// slave could come back having forgotten a transaction its master is about
+// to commit. With a durable engine they are journaled in txns.log in the
+// data directory, in the kv_store.log line format (see package oplog):
+//
+//	PREPARE "txnID" "<changes>" 0 0    a prepared transaction, changes as in a TXN record
+//	DONE "txnID" "" 0 0                a prepared transaction committed or aborted
+//
+// Every snapshot_every changes the engine takes a snapshot and the journal
+// is rewritten with only the transactions still prepared. The snapshot also
+// drops tombstones older than tombstone_grace.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kvstore/hlc"
+	"kvstore/oplog"
+	"kvstore/storage"
+)
+
+// Directory holding the slave's files, how many changes trigger a
+// snapshot, and how long tombstones are kept. All are set from the command
+// line.
+var data_dir string
+var snapshot_every int
+var tombstone_grace time.Duration
+
+var txn_log *os.File // nil if the engine keeps nothing across restarts, guarded by txn_mutex
+var changes int64    // changes since the last snapshot, updated atomically
+
+var snapshot_mutex sync.Mutex // held while a snapshot is being taken
+
+func txnLogPath() string { return filepath.Join(data_dir, "txns.log") }
+
+// tombstonesBefore is the version below which tombstones may be forgotten
+// (0 for none). A tombstone only needs to outlive every copy of the value
+// it replaced: the masters keep deletes a slave missed for their hint
+// window, and anti-entropy passes one on in the meantime, so the grace
+// period must be longer than that window.
+func tombstonesBefore() uint64 {
+	if tombstone_grace <= 0 {
+		return 0
+	}
+	return hlc.At(time.Now().Add(-tombstone_grace))
+}
+
+// toRecord turns a change for key into a log record.
+func toRecord(key string, e entry) oplog.Entry {
+	if e.Deleted {
+		return oplog.Entry{Op: "DELETE", Key: key, Version: e.Version}
+	}
+	return oplog.Entry{Op: "WRITE", Key: key, Value: e.Value, ExpiresAt: e.ExpiresAt, Version: e.Version}
+}
+
+// fromRecord is the inverse of toRecord.
+func fromRecord(r oplog.Entry) entry {
+	return entry{Value: r.Value, Deleted: r.Op == "DELETE", ExpiresAt: r.ExpiresAt, Version: r.Version}
+}
+
+// preparedRecord journals a prepared transaction with all of its changes.
+func preparedRecord(txnID string, changes []staged) oplog.Entry {
+	ops := make([]oplog.Entry, len(changes))
+	for i, change := range changes {
+		ops[i] = toRecord(change.key, change.entry)
+	}
+	return oplog.Entry{Op: "PREPARE", Key: txnID, Value: oplog.FormatTxn(ops)}
+}
+
+// openStorage opens the engine called kind and, if it is durable, recovers
+// the prepared transactions from the journal.
+func openStorage(kind string) error {
+	var err error
+	data_store, err = storage.Open(kind, data_dir)
+	if err != nil {
+		return err
+	}
+	if !data_store.Durable() {
+		fmt.Println("Using in-memory storage; data will be lost on exit")
+		return nil
+	}
+
+	err = replayTxnLog()
+	if err != nil {
+		return fmt.Errorf("replaying %s: %v", txnLogPath(), err)
+	}
+	txn_log, err = os.OpenFile(txnLogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	keys := scan("", "", "", 0)
+	fmt.Printf("Recovered %d keys and %d prepared transactions from %s\n", len(keys), len(prepared_txns), data_dir)
+	return nil
+}
+
+func replayTxnLog() error {
+	file, err := os.Open(txnLogPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// A last line without its newline was cut short by a crash
+			// before it was synced, so it was never acknowledged.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record, err := oplog.Parse(line[:len(line)-1])
+		if err != nil {
+			return err
+		}
+
+		switch record.Op {
+		case "PREPARE":
+			ops, err := oplog.ParseTxn(record.Value)
+			if err != nil {
+				return err
+			}
+			changes := make([]staged, len(ops))
+			for i, op := range ops {
+				changes[i] = staged{key: op.Key, entry: fromRecord(op)}
+			}
+			prepared_txns[record.Key] = changes
+		case "DONE":
+			delete(prepared_txns, record.Key)
+		}
+	}
+}
+
+// logTxn appends record to the journal and syncs it. Like a failed write
+// to the engine, failing here is fatal. Callers hold txn_mutex.
+func logTxn(record oplog.Entry) {
+	if txn_log == nil {
+		return
+	}
+	_, err := txn_log.WriteString(oplog.Format(record) + "\n")
+	if err == nil {
+		err = txn_log.Sync()
+	}
+	must(err)
+	changed()
+}
+
+// changed counts a change towards the next snapshot.
+func changed() {
+	atomic.AddInt64(&changes, 1)
+}
+
+// maybeSnapshot has the engine take a snapshot, and rewrites the journal,
+// once enough changes have been made. If another request is already
+// taking one, it leaves it to that one.
+func maybeSnapshot() {
+	if atomic.LoadInt64(&changes) < int64(snapshot_every) || !snapshot_mutex.TryLock() {
+		return
+	}
+	defer snapshot_mutex.Unlock()
+	counted := atomic.LoadInt64(&changes)
+	if counted < int64(snapshot_every) {
+		// A snapshot that finished just now covered them
+		return
+	}
+
+	err := data_store.Snapshot(tombstonesBefore())
+	if err == nil && txn_log != nil {
+		txn_mutex.Lock()
+		err = rewriteTxnLog()
+		txn_mutex.Unlock()
+	}
+	if err != nil {
+		// Nothing is lost; try again after the next change
+		fmt.Printf("Error taking snapshot: %v\n", err)
+		return
+	}
+	// Changes made while the snapshot was taken count towards the next one
+	atomic.AddInt64(&changes, -counted)
+	fmt.Println("Took a snapshot")
+}
+
+// rewriteTxnLog replaces the journal with one holding only the transactions
+// still prepared. Callers hold txn_mutex.
+func rewriteTxnLog() error {
+	tmpPath := txnLogPath() + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for txnID, changes := range prepared_txns {
+		writer.WriteString(oplog.Format(preparedRecord(txnID, changes)) + "\n")
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, txnLogPath())
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	txn_log.Close()
+	txn_log, err = os.OpenFile(txnLogPath(), os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"kvstore/oplog"
+)
+
+// Log keeps every change in an append-only file, data.log in its
+// directory, one line per change in the kv_store.log format (see package
+// oplog):
+//
+//	WRITE "key" "value" expiresAt version
+//	DELETE "key" "" 0 version
+//
+// An index in memory points each key at its latest line, so a Get reads a
+// single line from disk. Every change is synced before Put or Delete
+// returns. Snapshot rewrites the file with only the latest line of each
+// key, and drops old tombstones.
+//
+// Gets and Scans run in parallel; changes are appended one at a time, as
+// they have to go through the one file anyway.
+type Log struct {
+	mu    sync.RWMutex // guards file, size and index
+	dir   string
+	file  *os.File
+	size  int64 // where the next line goes
+	index map[string]location
+}
+
+// location is where a line sits in data.log, newline included.
+type location struct {
+	offset int64
+	length int
+}
+
+// OpenLog opens the log in dir, creating both if needed, and indexes it.
+func OpenLog(dir string) (*Log, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, index: make(map[string]location)}
+	l.file, err = os.OpenFile(l.path(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = l.load()
+	if err != nil {
+		l.file.Close()
+		return nil, fmt.Errorf("reading %s: %v", l.path(), err)
+	}
+	return l, nil
+}
+
+func (l *Log) path() string { return filepath.Join(l.dir, "data.log") }
+
+// load indexes every line of the file.
+func (l *Log) load() error {
+	reader := bufio.NewReader(l.file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// A last line without its newline was cut short by a crash
+			// before it was synced, so it was never acknowledged.
+			return l.file.Truncate(l.size)
+		}
+		if err != nil {
+			return err
+		}
+		record, err := oplog.Parse(line[:len(line)-1])
+		if err != nil {
+			return err
+		}
+		l.index[record.Key] = location{offset: l.size, length: len(line)}
+		l.size += int64(len(line))
+	}
+}
+
+func (l *Log) Get(key string) (Entry, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	loc, ok := l.index[key]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	record, err := readRecord(l.file, loc)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return Entry{Value: record.Value, Deleted: record.Op == "DELETE", ExpiresAt: record.ExpiresAt, Version: record.Version}, true, nil
+}
+
+func readRecord(file *os.File, loc location) (oplog.Entry, error) {
+	buf := make([]byte, loc.length)
+	_, err := file.ReadAt(buf, loc.offset)
+	if err != nil {
+		return oplog.Entry{}, err
+	}
+	return oplog.Parse(string(buf[:len(buf)-1]))
+}
+
+func (l *Log) Put(key string, e Entry) error {
+	record := oplog.Entry{Op: "WRITE", Key: key, Value: e.Value, ExpiresAt: e.ExpiresAt, Version: e.Version}
+	if e.Deleted {
+		record = oplog.Entry{Op: "DELETE", Key: key, Version: e.Version}
+	}
+	return l.append(record)
+}
+
+func (l *Log) Delete(key string, version uint64) error {
+	return l.append(oplog.Entry{Op: "DELETE", Key: key, Version: version})
+}
+
+func (l *Log) append(record oplog.Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	line := oplog.Format(record) + "\n"
+	_, err := l.file.WriteAt([]byte(line), l.size)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	l.index[record.Key] = location{offset: l.size, length: len(line)}
+	l.size += int64(len(line))
+	return nil
+}
+
+func (l *Log) Scan(start, end, prefix string, limit int) ([]string, error) {
+	l.mu.RLock()
+	keys := matchKeys(l.index, start, end, prefix)
+	l.mu.RUnlock()
+	return sortKeys(keys, limit), nil
+}
+
+// Snapshot copies the latest line of every key, bar old tombstones, to a
+// new file and swaps it in. Until the rename the old file is untouched, so
+// a crash at any point leaves one complete log or the other. Changes wait
+// until it is done.
+func (l *Log) Snapshot(tombstonesBefore uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tmpPath := l.path() + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]location, len(l.index))
+	var size int64
+	writer := bufio.NewWriter(tmp)
+	for key, loc := range l.index {
+		buf := make([]byte, loc.length)
+		_, err = l.file.ReadAt(buf, loc.offset)
+		if err != nil {
+			break
+		}
+		if tombstonesBefore > 0 {
+			var record oplog.Entry
+			record, err = oplog.Parse(string(buf[:len(buf)-1]))
+			if err != nil {
+				break
+			}
+			if record.Op == "DELETE" && record.Version < tombstonesBefore {
+				continue
+			}
+		}
+		writer.Write(buf)
+		index[key] = location{offset: size, length: loc.length}
+		size += int64(loc.length)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, l.path())
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Make the rename itself durable
+	if dir, err := os.Open(l.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	l.file.Close()
+	l.file, l.index, l.size = tmp, index, size
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+func (l *Log) Durable() bool { return true }
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryShards is how many maps the Memory engine splits its keys over;
+// every key hashes onto one of them.
+const memoryShards = 64
+
+// Memory keeps everything in maps. It is the fastest engine and keeps
+// nothing across restarts. Keys are spread over shards, each with its own
+// lock, so requests for different keys rarely wait for one another.
+type Memory struct {
+	shards [memoryShards]memoryShard
+}
+
+type memoryShard struct {
+	mu      sync.RWMutex
+	entries map[string]Entry
+}
+
+func NewMemory() *Memory {
+	m := &Memory{}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[string]Entry)
+	}
+	return m
+}
+
+func (m *Memory) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &m.shards[h.Sum32()%memoryShards]
+}
+
+func (m *Memory) Get(key string) (Entry, bool, error) {
+	shard := m.shard(key)
+	shard.mu.RLock()
+	e, ok := shard.entries[key]
+	shard.mu.RUnlock()
+	return e, ok, nil
+}
+
+func (m *Memory) Put(key string, e Entry) error {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	shard.entries[key] = e
+	shard.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) Delete(key string, version uint64) error {
+	return m.Put(key, Entry{Deleted: true, Version: version})
+}
+
+// Scan visits the shards one at a time, so it never holds up more than one
+// shard's writers. A key changed during the scan may or may not be listed.
+func (m *Memory) Scan(start, end, prefix string, limit int) ([]string, error) {
+	var keys []string
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.RLock()
+		keys = append(keys, matchKeys(shard.entries, start, end, prefix)...)
+		shard.mu.RUnlock()
+	}
+	return sortKeys(keys, limit), nil
+}
+
+// Snapshot only drops old tombstones; there is nothing else to bring up to
+// date.
+func (m *Memory) Snapshot(tombstonesBefore uint64) error {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		for key, e := range shard.entries {
+			if e.Deleted && e.Version < tombstonesBefore {
+				delete(shard.entries, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+func (m *Memory) Close() error  { return nil }
+func (m *Memory) Durable() bool { return false }
+
+// matchKeys returns the keys of entries that are >= start, < end (if end is
+// set) and have prefix, in no particular order.
+func matchKeys[V any](entries map[string]V, start, end, prefix string) []string {
+	var keys []string
+	for key := range entries {
+		if key >= start && (end == "" || key < end) && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// sortKeys sorts keys and keeps the first limit of them (all if limit <= 0).
+func sortKeys(keys []string, limit int) []string {
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
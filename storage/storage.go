@@ -0,0 +1,61 @@
+// Package storage holds a slave's data. Engines differ in where the data
+// lives: Memory keeps it in a map and loses it on exit, Log keeps it in an
+// append-only file on disk and survives restarts.
+//
+// Engines store whatever they are given; deciding whether a change should
+// replace what is stored (by version, say) is up to the caller.
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// Entry is what is held for one key. Deleted keys are kept as tombstones so
+// their version is not lost.
+type Entry struct {
+	Value     string
+	Deleted   bool
+	ExpiresAt int64 // Unix milliseconds, 0 for no expiry
+	Version   uint64
+}
+
+// Live reports whether e holds a value that has not expired at now.
+func (e Entry) Live(now time.Time) bool {
+	return !e.Deleted && (e.ExpiresAt == 0 || now.UnixMilli() < e.ExpiresAt)
+}
+
+// Engine is a slave's storage. Engines are safe for concurrent use, but
+// each call stands alone: a caller that reads a key and then changes it
+// must keep others off the key in between.
+type Engine interface {
+	// Get returns the entry for key and whether there is one.
+	Get(key string) (Entry, bool, error)
+	// Put stores e under key.
+	Put(key string, e Entry) error
+	// Delete replaces key with a tombstone at version.
+	Delete(key string, version uint64) error
+	// Scan returns, in order, up to limit keys (all if limit <= 0) that are
+	// >= start, < end (if end is set) and have prefix. Tombstones are
+	// included.
+	Scan(start, end, prefix string, limit int) ([]string, error)
+	// Snapshot brings the stored form up to date with the current contents,
+	// dropping superseded history, so reopening is fast. Tombstones below
+	// version tombstonesBefore are dropped too (none if it is 0).
+	Snapshot(tombstonesBefore uint64) error
+	// Close releases the engine's files.
+	Close() error
+	// Durable reports whether the data survives a restart.
+	Durable() bool
+}
+
+// Open returns the engine called kind, keeping its files under dir.
+func Open(kind, dir string) (Engine, error) {
+	switch kind {
+	case "memory":
+		return NewMemory(), nil
+	case "log":
+		return OpenLog(dir)
+	}
+	return nil, fmt.Errorf("unknown storage engine %q (want memory or log)", kind)
+}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// engines opens one engine of every kind in a fresh directory.
+func engines(t *testing.T) map[string]Engine {
+	t.Helper()
+	all := make(map[string]Engine)
+	for _, kind := range []string{"memory", "log"} {
+		e, err := Open(kind, t.TempDir())
+		if err != nil {
+			t.Fatalf("Open(%q): %v", kind, err)
+		}
+		t.Cleanup(func() { e.Close() })
+		all[kind] = e
+	}
+	return all
+}
+
+func TestEngineGetPutDelete(t *testing.T) {
+	for kind, e := range engines(t) {
+		t.Run(kind, func(t *testing.T) {
+			if _, ok, err := e.Get("missing"); ok || err != nil {
+				t.Fatalf("Get of a missing key = %v, %v", ok, err)
+			}
+			steps := []struct {
+				key  string
+				put  *Entry // nil deletes
+				ver  uint64
+				want Entry
+			}{
+				{key: "a", put: &Entry{Value: "1", Version: 1}, want: Entry{Value: "1", Version: 1}},
+				{key: "a", put: &Entry{Value: "2", ExpiresAt: 99, Version: 2}, want: Entry{Value: "2", ExpiresAt: 99, Version: 2}},
+				{key: "b", put: &Entry{Value: "line\n\"quoted\" ", Version: 3}, want: Entry{Value: "line\n\"quoted\" ", Version: 3}},
+				{key: "a", ver: 4, want: Entry{Deleted: true, Version: 4}},
+				{key: "c", put: &Entry{Deleted: true, Version: 5}, want: Entry{Deleted: true, Version: 5}},
+				{key: "a", put: &Entry{Value: "back", Version: 6}, want: Entry{Value: "back", Version: 6}},
+			}
+			for i, s := range steps {
+				var err error
+				if s.put != nil {
+					err = e.Put(s.key, *s.put)
+				} else {
+					err = e.Delete(s.key, s.ver)
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				got, ok, err := e.Get(s.key)
+				if !ok || err != nil || got != s.want {
+					t.Fatalf("step %d: Get(%q) = %+v, %v, %v, want %+v", i, s.key, got, ok, err, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEngineScan(t *testing.T) {
+	keys := []string{"user:3", "user:1", "item:1", "user:2", "item:2", "zz"}
+	tests := []struct {
+		start, end, prefix string
+		limit              int
+		want               []string
+	}{
+		{want: []string{"item:1", "item:2", "user:1", "user:2", "user:3", "zz"}},
+		{prefix: "user:", want: []string{"user:1", "user:2", "user:3"}},
+		{prefix: "user:", limit: 2, want: []string{"user:1", "user:2"}},
+		{start: "user:2", want: []string{"user:2", "user:3", "zz"}},
+		{start: "item:2", end: "user:3", want: []string{"item:2", "user:1", "user:2"}},
+		{prefix: "none"},
+	}
+	for kind, e := range engines(t) {
+		for i, key := range keys {
+			e.Put(key, Entry{Value: key, Version: uint64(i + 1)})
+		}
+		e.Delete("zz", 10) // tombstones are listed too
+		for _, tt := range tests {
+			got, err := e.Scan(tt.start, tt.end, tt.prefix, tt.limit)
+			if err != nil || !slices.Equal(got, tt.want) {
+				t.Errorf("%s: Scan(%q, %q, %q, %d) = %q, %v, want %q", kind, tt.start, tt.end, tt.prefix, tt.limit, got, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestEngineSnapshotDropsOldTombstones(t *testing.T) {
+	// "old" and "new" are tombstones at versions 5 and 10; "live" is a
+	// value at version 1
+	tests := []struct {
+		name   string
+		before uint64
+		want   []string
+	}{
+		{"keeping all", 0, []string{"live", "new", "old"}},
+		{"older than all", 5, []string{"live", "new", "old"}},
+		{"between", 6, []string{"live", "new"}},
+		{"newer than all", 100, []string{"live"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for kind, e := range engines(t) {
+				e.Put("live", Entry{Value: "v", Version: 1})
+				e.Put("old", Entry{Value: "v", Version: 2})
+				e.Delete("old", 5)
+				e.Delete("new", 10)
+				if err := e.Snapshot(tt.before); err != nil {
+					t.Fatalf("%s: Snapshot(%d): %v", kind, tt.before, err)
+				}
+				if got, _ := e.Scan("", "", "", 0); !slices.Equal(got, tt.want) {
+					t.Errorf("%s: keys after Snapshot(%d) = %q, want %q", kind, tt.before, got, tt.want)
+				}
+				if got, ok, _ := e.Get("live"); !ok || got.Value != "v" {
+					t.Errorf("%s: live key = %+v, %v after Snapshot(%d)", kind, got, ok, tt.before)
+				}
+			}
+		})
+	}
+}
+
+func TestEntryLive(t *testing.T) {
+	now := time.UnixMilli(1000)
+	tests := []struct {
+		e    Entry
+		want bool
+	}{
+		{Entry{Value: "v"}, true},
+		{Entry{Value: "v", ExpiresAt: 1001}, true},
+		{Entry{Value: "v", ExpiresAt: 1000}, false},
+		{Entry{Deleted: true}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.e.Live(now); got != tt.want {
+			t.Errorf("%+v.Live = %v, want %v", tt.e, got, tt.want)
+		}
+	}
+}
+
+func TestOpenUnknown(t *testing.T) {
+	if _, err := Open("btree", t.TempDir()); err == nil {
+		t.Fatal("Open accepted an unknown engine")
+	}
+}
+
+// fill puts the same changes in l and returns what each key should hold.
+func fill(t *testing.T, l *Log) map[string]Entry {
+	t.Helper()
+	want := map[string]Entry{
+		"a": {Value: "3", Version: 3},
+		"b": {Deleted: true, Version: 4},
+		"c": {Value: "multi\nline", ExpiresAt: 5000, Version: 5},
+	}
+	for _, step := range []func() error{
+		func() error { return l.Put("a", Entry{Value: "1", Version: 1}) },
+		func() error { return l.Put("b", Entry{Value: "2", Version: 2}) },
+		func() error { return l.Put("a", Entry{Value: "3", Version: 3}) },
+		func() error { return l.Delete("b", 4) },
+		func() error { return l.Put("c", want["c"]) },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return want
+}
+
+func check(t *testing.T, l *Log, want map[string]Entry) {
+	t.Helper()
+	for key, w := range want {
+		got, ok, err := l.Get(key)
+		if !ok || err != nil || got != w {
+			t.Fatalf("Get(%q) = %+v, %v, %v, want %+v", key, got, ok, err, w)
+		}
+	}
+	keys, _ := l.Scan("", "", "", 0)
+	if len(keys) != len(want) {
+		t.Fatalf("Scan = %q, want %d keys", keys, len(want))
+	}
+}
+
+func TestLogReopen(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot bool
+	}{
+		{"without snapshot", false},
+		{"after snapshot", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := OpenLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fill(t, l)
+			if tt.snapshot {
+				if err := l.Snapshot(0); err != nil {
+					t.Fatalf("Snapshot: %v", err)
+				}
+				check(t, l, want)
+				data, _ := os.ReadFile(filepath.Join(dir, "data.log"))
+				if lines := strings.Count(string(data), "\n"); lines != len(want) {
+					t.Fatalf("snapshot kept %d lines, want %d", lines, len(want))
+				}
+				// Changes after a snapshot go to the new file
+				want["d"] = Entry{Value: "after", Version: 6}
+				l.Put("d", want["d"])
+			}
+			l.Close()
+
+			l, err = OpenLog(dir)
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			defer l.Close()
+			check(t, l, want)
+		})
+	}
+}
+
+func TestLogTruncatedTail(t *testing.T) {
+	tails := []struct {
+		name string
+		tail string
+	}{
+		{"cut in the op", "WRI"},
+		{"cut in a quoted field", `WRITE "x" "half a val`},
+		{"cut before the newline", `WRITE "x" "v" 0 7`},
+	}
+	for _, tt := range tails {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := OpenLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fill(t, l)
+			l.Close()
+
+			path := filepath.Join(dir, "data.log")
+			intact, _ := os.ReadFile(path)
+			f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			f.WriteString(tt.tail)
+			f.Close()
+
+			l, err = OpenLog(dir)
+			if err != nil {
+				t.Fatalf("reopening after a torn write: %v", err)
+			}
+			check(t, l, want)
+			if _, ok, _ := l.Get("x"); ok {
+				t.Fatal("the torn line was indexed")
+			}
+			if data, _ := os.ReadFile(path); string(data) != string(intact) {
+				t.Fatalf("torn tail left in the file: %q", data[len(intact):])
+			}
+
+			// The next change lands where the torn line was
+			want["e"] = Entry{Value: "next", Version: 8}
+			if err := l.Put("e", want["e"]); err != nil {
+				t.Fatal(err)
+			}
+			l.Close()
+			l, err = OpenLog(dir)
+			if err != nil {
+				t.Fatalf("reopening after the repair: %v", err)
+			}
+			defer l.Close()
+			check(t, l, want)
+		})
+	}
+}
+
+func TestLogCorruptLine(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "data.log"), []byte("WRITE \"a\" \"1\" 0 1\nWRITE \"broken\n"), 0644)
+	if l, err := OpenLog(dir); err == nil {
+		l.Close()
+		t.Fatal("OpenLog accepted a corrupt complete line")
+	}
+}
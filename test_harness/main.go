@@ -13,10 +13,11 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"kvstore/protocol"
 )
 
 const (
@@ -66,6 +67,7 @@ type TestClient struct {
 	ConnPool  []net.Conn
 	StopChan  chan struct{}
 	WaitGroup *sync.WaitGroup
+	nextReqID uint32
 }
 
 type SlaveProcess struct {
@@ -73,14 +75,29 @@ type SlaveProcess struct {
 	Cmd  *exec.Cmd
 }
 
-func NewSlaveProcess(port int) *SlaveProcess {
-	cmd := exec.Command("go", "run", "slave/main.go", strconv.Itoa(port))
+// NewSlaveProcess runs the slave binary at bin. Every slave needs a data
+// directory of its own, so each gets one under ResultsDir named after its
+// number.
+func NewSlaveProcess(bin string, port int) *SlaveProcess {
+	cmd := exec.Command(bin, "-data", filepath.Join(ResultsDir, "slave-data", strconv.Itoa(port)))
 	return &SlaveProcess{
 		Port: port,
 		Cmd:  cmd,
 	}
 }
 
+// buildSlave compiles the slave package once for all the slave processes
+// and returns the path of the binary.
+func buildSlave() (string, error) {
+	bin, err := filepath.Abs(filepath.Join(ResultsDir, "slave-bin"))
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("go", "build", "-o", bin, "./slave")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return bin, cmd.Run()
+}
+
 func (s *SlaveProcess) Start() error {
 	return s.Cmd.Start()
 }
@@ -96,7 +113,7 @@ func NewTestClient(id int) *TestClient {
 		if err != nil {
 			log.Fatalf("Client %d: Failed to connect: %v", id, err)
 		}
-		conn.Write([]byte("CLIENT"))
+		protocol.WriteFrame(conn, protocol.NewFrame(protocol.OpHello, 0, "CLIENT"))
 		connPool[i] = conn
 	}
 	return &TestClient{
@@ -107,6 +124,24 @@ func NewTestClient(id int) *TestClient {
 	}
 }
 
+func (c *TestClient) roundTrip(conn net.Conn, op protocol.Op, args ...string) (protocol.Op, error) {
+	c.nextReqID++
+	conn.SetDeadline(time.Now().Add(RequestTimeout))
+	err := protocol.WriteFrame(conn, protocol.NewFrame(op, c.nextReqID, args...))
+	if err != nil {
+		return 0, err
+	}
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return 0, err
+		}
+		if frame.ReqID == c.nextReqID {
+			return frame.Op, nil
+		}
+	}
+}
+
 func (c *TestClient) Run() {
 	c.WaitGroup.Add(1)
 	defer c.WaitGroup.Done()
@@ -131,26 +166,20 @@ func (c *TestClient) Run() {
 
 			if isWrite {
 				value := fmt.Sprintf("value%d", rand.Intn(10000))
-				_, err = conn.Write([]byte(fmt.Sprintf("WRITE %s %s", key, value)))
-				if err == nil {
-					buf := make([]byte, 1024)
-					n, err := conn.Read(buf)
-					if err == nil && string(buf[:n]) != "WRITE_DONE" {
-						err = fmt.Errorf("unexpected write response")
-					}
+				var response protocol.Op
+				response, err = c.roundTrip(conn, protocol.OpWrite, key, value)
+				if err == nil && response != protocol.OpOK {
+					err = fmt.Errorf("unexpected write response")
 				}
 
 				latency := uint64(time.Since(start).Microseconds())
 				atomic.AddUint64(&globalMetrics.writeLatencySum, latency)
 				atomic.AddUint64(&globalMetrics.writeCount, 1)
 			} else {
-				_, err = conn.Write([]byte(fmt.Sprintf("READ %s", key)))
-				if err == nil {
-					buf := make([]byte, 1024)
-					n, err := conn.Read(buf)
-					if err == nil && strings.Contains(string(buf[:n]), "NOT FOUND") {
-						err = nil
-					}
+				var response protocol.Op
+				response, err = c.roundTrip(conn, protocol.OpRead, key)
+				if err == nil && response == protocol.OpError {
+					err = fmt.Errorf("unexpected read response")
 				}
 
 				latency := uint64(time.Since(start).Microseconds())
@@ -228,9 +257,18 @@ func NewTestController(numSlaves, numClients int) *TestController {
 		csvWriter.Flush()
 	}
 
+	slaveBin, err := buildSlave()
+	if err != nil {
+		log.Fatalf("Failed to build the slave: %v", err)
+	}
+	// Every run starts with empty slaves
+	if err := os.RemoveAll(filepath.Join(ResultsDir, "slave-data")); err != nil {
+		log.Fatal(err)
+	}
+
 	slaveProcs := make([]*SlaveProcess, numSlaves)
 	for i := 0; i < numSlaves; i++ {
-		slave := NewSlaveProcess(20000 + i)
+		slave := NewSlaveProcess(slaveBin, 20000+i)
 		if err := slave.Start(); err != nil {
 			log.Fatalf("Failed to start slave on port %d: %v", 20000+i, err)
 		}